@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"github.com/buger/goterm"
-	"github.com/smartystreets/goconvey/convey"
 )
 
 type assertionError struct {
@@ -44,19 +43,39 @@ func Assert(t TestInfo, message string, actual interface{}, f func(interface{},
 		panic(r)
 	}
 
+	t.steps.touch()
+
 	fmt.Fprint(t, goterm.Color(fmt.Sprintf("- [PASS] %s", message), goterm.GREEN)) // nolint
 	fmt.Fprintln(t)                                                                // nolint
 }
 
 // Step runs a particular step.
+// Steps can be nested by calling Step from within the step function.
+// Each step is recorded with its timing and status, and reported
+// as a tree along with the test iteration log.
+// If the step function returns an error, the test fails with a StepError.
 func Step(t TestInfo, name string, step func() error) {
 
-	start := time.Now()
-	fmt.Fprintf(t, "%s\n", name) // nolint
+	s, parents := t.steps.begin(name)
+	indent := strings.Repeat("  ", len(parents))
+
+	status := StepStatusFailed
+	defer func() { t.steps.end(s, status) }()
+
+	fmt.Fprintf(t, "%s%s\n", indent, name) // nolint
 	if err := step(); err != nil {
-		fmt.Fprintf(t, "%s\n", goterm.Color(fmt.Sprintf("took: %s", time.Since(start).Round(time.Millisecond)), goterm.BLUE)) // nolint
-		Assert(t, "step should not return any error", err, convey.ShouldBeNil)
+		duration := time.Since(s.Start)
+		fmt.Fprintf(t, "%s%s\n", indent, goterm.Color(fmt.Sprintf("took: %s", duration.Round(time.Millisecond)), goterm.BLUE)) // nolint
+		fmt.Fprintf(t, "%s%s\n", indent, goterm.Color(fmt.Sprintf("- [FAIL] step returned an error: %s", err), goterm.RED))    // nolint
+
+		panic(StepError{
+			Name:     name,
+			Path:     parents,
+			Err:      err,
+			Duration: duration,
+		})
 	}
 
-	fmt.Fprintf(t, "%s\n\n", goterm.Color(fmt.Sprintf("took: %s", time.Since(start).Round(time.Millisecond)), goterm.BLUE)) // nolint
+	status = StepStatusPassed
+	fmt.Fprintf(t, "%s%s\n\n", indent, goterm.Color(fmt.Sprintf("took: %s", time.Since(s.Start).Round(time.Millisecond)), goterm.BLUE)) // nolint
 }
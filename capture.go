@@ -0,0 +1,192 @@
+package apocheck
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goterm"
+	"go.aporeto.io/elemental"
+)
+
+// captureMaxBodySize is the maximum size of the captured bodies.
+const captureMaxBodySize = 4096
+
+// sensitiveFieldNames matches the names of the fields whose value must not be captured.
+const sensitiveFieldNames = `password|passphrase|token|secret|key`
+
+// sensitiveFieldsRegexp matches JSON fields whose value must not be captured.
+var sensitiveFieldsRegexp = regexp.MustCompile(`(?i)("[^"]*(` + sensitiveFieldNames + `)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// sensitiveFieldNameRegexp matches the names of the fields whose value must not be captured.
+var sensitiveFieldNameRegexp = regexp.MustCompile(`(?i)` + sensitiveFieldNames)
+
+// An httpExchange is an HTTP request made by a manipulator
+// along with its response. The bodies are kept formatted by
+// formatBody, so only their readable, redacted and size capped
+// version stays in memory.
+type httpExchange struct {
+	method       string
+	url          string
+	namespace    string
+	header       http.Header
+	status       int
+	responseType string
+	duration     time.Duration
+	err          error
+	requestBody  string
+	responseBody string
+}
+
+// httpRecorder records the HTTP exchanges of a test iteration.
+type httpRecorder struct {
+	exchanges []*httpExchange
+	lock      sync.Mutex
+}
+
+func newHTTPRecorder() *httpRecorder {
+	return &httpRecorder{}
+}
+
+func (r *httpRecorder) record(e *httpExchange) {
+
+	r.lock.Lock()
+	r.exchanges = append(r.exchanges, e)
+	r.lock.Unlock()
+}
+
+// snapshot returns the exchanges recorded so far.
+func (r *httpRecorder) snapshot() []*httpExchange {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]*httpExchange{}, r.exchanges...)
+}
+
+// transport returns a transportWrapper recording the exchanges.
+func (r *httpRecorder) transport(next http.RoundTripper) http.RoundTripper {
+
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+
+		e := &httpExchange{
+			method:    req.Method,
+			url:       req.URL.String(),
+			namespace: req.Header.Get("X-Namespace"),
+			header:    req.Header.Clone(),
+		}
+
+		if req.Body != nil && req.Body != http.NoBody {
+			data, err := io.ReadAll(req.Body)
+			req.Body.Close() // nolint
+			if err != nil {
+				return nil, err
+			}
+
+			e.requestBody = formatBody(data, req.Header.Get("Content-Type"))
+
+			req = req.Clone(req.Context())
+			req.Body = io.NopCloser(bytes.NewReader(data))
+		}
+
+		start := time.Now()
+		resp, err := next.RoundTrip(req)
+		e.duration = time.Since(start)
+		e.err = err
+
+		if resp != nil {
+			e.status = resp.StatusCode
+			e.responseType = resp.Header.Get("Content-Type")
+
+			if resp.Body != nil {
+				data, rerr := io.ReadAll(resp.Body)
+				resp.Body.Close() // nolint
+				if rerr != nil {
+					e.err = rerr
+				}
+
+				e.responseBody = formatBody(data, e.responseType)
+				resp.Body = io.NopCloser(bytes.NewReader(data))
+			}
+		}
+
+		r.record(e)
+
+		return resp, err
+	})
+}
+
+// formatBody returns a readable, redacted and size capped version of
+// the given body. Msgpack bodies are converted to JSON. The sensitive
+// fields are redacted before the body is capped, so a value cut in the
+// middle is not left.
+func formatBody(data []byte, contentType string) string {
+
+	if len(data) == 0 {
+		return ""
+	}
+
+	if strings.Contains(contentType, "msgpack") {
+		var obj interface{}
+		if err := elemental.Decode(elemental.EncodingTypeMSGPACK, data, &obj); err != nil {
+			return fmt.Sprintf("<%d bytes of undecodable msgpack>", len(data))
+		}
+
+		d, err := json.Marshal(obj)
+		if err != nil {
+			return fmt.Sprintf("<%d bytes of unencodable msgpack>", len(data))
+		}
+		data = d
+	}
+
+	out := sensitiveFieldsRegexp.ReplaceAllString(string(data), `$1"<redacted>"`)
+
+	if len(out) > captureMaxBodySize {
+		out = fmt.Sprintf("%s... <%d bytes truncated>", out[:captureMaxBodySize], len(out)-captureMaxBodySize)
+	}
+
+	return out
+}
+
+// formatExchanges returns the given exchanges as text.
+func formatExchanges(exchanges []*httpExchange, indent string) string {
+
+	b := &strings.Builder{}
+
+	for _, e := range exchanges {
+
+		status := fmt.Sprintf("%d", e.status)
+		color := goterm.GREEN
+		if e.err != nil {
+			status = fmt.Sprintf("error: %s", e.err)
+			color = goterm.RED
+		} else if e.status >= 400 {
+			color = goterm.RED
+		}
+
+		fmt.Fprintf(b, "%s%s %s ns=%s -> %s %s\n", // nolint
+			indent,
+			e.method,
+			e.url,
+			e.namespace,
+			goterm.Color(status, color),
+			goterm.Color(fmt.Sprintf("(%s)", e.duration.Round(time.Millisecond)), goterm.BLUE),
+		)
+
+		if e.requestBody != "" {
+			fmt.Fprintf(b, "%s  request: %s\n", indent, e.requestBody) // nolint
+		}
+
+		if e.responseBody != "" {
+			fmt.Fprintf(b, "%s  response: %s\n", indent, e.responseBody) // nolint
+		}
+	}
+
+	return b.String()
+}
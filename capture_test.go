@@ -0,0 +1,67 @@
+package apocheck
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func Test_formatBody(t *testing.T) {
+
+	long := `{"password":"` + strings.Repeat("a", captureMaxBodySize) + `","name":"` + strings.Repeat("b", captureMaxBodySize) + `"}`
+	redactedLong := `{"password":"<redacted>","name":"` + strings.Repeat("b", captureMaxBodySize) + `"}`
+
+	tests := []struct {
+		name        string
+		data        string
+		contentType string
+		want        string
+	}{
+		{"empty", "", "application/json", ""},
+		{"json", `{"name":"a"}`, "application/json", `{"name":"a"}`},
+		{"sensitive fields", `{"name":"a","passphrase":"b","apiToken":"c"}`, "application/json", `{"name":"a","passphrase":"<redacted>","apiToken":"<redacted>"}`},
+		{
+			"redacted before being capped",
+			long,
+			"application/json",
+			redactedLong[:captureMaxBodySize] + fmt.Sprintf("... <%d bytes truncated>", len(redactedLong)-captureMaxBodySize),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatBody([]byte(tt.data), tt.contentType); got != tt.want {
+				t.Errorf("formatBody() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_httpRecorderTransport(t *testing.T) {
+
+	body := strings.Repeat("a", 10*captureMaxBodySize)
+
+	r := newHTTPRecorder()
+	rt := r.transport(vcrServer)
+
+	got, _, err := doVCRRequest(t, rt, http.MethodPost, "https://api.example.com/namespaces", body)
+	if err != nil {
+		t.Fatalf("transport error = %v", err)
+	}
+
+	if want := "POST /namespaces " + body; got != want {
+		t.Errorf("transport must pass the full bodies, got %d bytes, want %d", len(got), len(want))
+	}
+
+	exchanges := r.snapshot()
+	if len(exchanges) != 1 {
+		t.Fatalf("snapshot() = %d exchanges, want 1", len(exchanges))
+	}
+
+	for _, b := range []string{exchanges[0].requestBody, exchanges[0].responseBody} {
+		if len(b) > captureMaxBodySize+len("... <000000 bytes truncated>") || !strings.HasSuffix(b, " bytes truncated>") {
+			t.Errorf("captured body of %d bytes, want it capped to %d bytes", len(b), captureMaxBodySize)
+		}
+	}
+}
@@ -5,24 +5,51 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"net/url"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/buger/goterm"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.aporeto.io/elemental"
+	"go.aporeto.io/manipulate"
 	"go.aporeto.io/tg/tglib"
-	"go.uber.org/zap"
 )
 
+type commandConfig struct {
+	modelManager elemental.ModelManager
+}
+
+// A CommandOption represents options to NewCommand.
+type CommandOption func(*commandConfig)
+
+// CommandOptionModelManager sets the model manager used to decode
+// push events. Default is the gaia one.
+func CommandOptionModelManager(manager elemental.ModelManager) CommandOption {
+	return func(cfg *commandConfig) {
+		cfg.modelManager = manager
+	}
+}
+
 // NewCommand generates a new CLI for regolith
 func NewCommand(
 	name string,
 	description string,
 	version string,
+	options ...CommandOption,
 ) *cobra.Command {
 
+	cfg := commandConfig{}
+	for _, opt := range options {
+		opt(&cfg)
+	}
+
+	if cfg.modelManager != nil {
+		mainModelManager = cfg.modelManager
+	}
+
 	cobra.OnInitialize(func() {
 		viper.SetEnvPrefix(name)
 		viper.AutomaticEnv()
@@ -32,8 +59,17 @@ func NewCommand(
 	var rootCmd = &cobra.Command{
 		Use:   name,
 		Short: description,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := viper.BindPFlags(cmd.Flags()); err != nil {
+				return err
+			}
+			return loadConfig(viper.GetString("config"), viper.GetString("profile"))
+		},
 	}
 
+	rootCmd.PersistentFlags().String("config", "", "Path to a yaml or toml configuration file whose keys are the flag names")
+	rootCmd.PersistentFlags().String("profile", "", "Name of the profile to use from the profiles section of the configuration file")
+
 	var versionCmd = &cobra.Command{
 		Use:   "version",
 		Short: "Prints the version and exit.",
@@ -72,125 +108,295 @@ func NewCommand(
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 
-			// TODO: add argument check.
+			if err := checkTestArguments(); err != nil {
+				return err
+			}
+
+			RegisterSecrets(viper.GetString("token"), viper.GetString("key-pass"), viper.GetString("vince-password"))
 
 			var caPoolPublic, caPoolPrivate *x509.CertPool
 			var systemCert *tls.Certificate
 			var err error
 
-			if path := viper.GetString("cacert-public"); path != "" {
+			// The memory backend and the replay mode do not use any credentials.
+			memory := viper.GetString("backend") == backendMemory || viper.GetString("replay") != ""
+
+			if path := viper.GetString("cacert-public"); path != "" && !memory {
 				caPoolPublic, err = setupPublicCA(path)
 				if err != nil {
 					return fmt.Errorf("unable to load public ca from path '%s': %s", path, err)
 				}
 			}
 
-			if path := viper.GetString("cacert-private"); path != "" {
+			if path := viper.GetString("cacert-private"); path != "" && !memory {
 				caPoolPrivate, err = setupPrivateCA(path)
 				if err != nil {
 					return fmt.Errorf("unable to load private ca from path '%s': %s", path, err)
 				}
 			}
 
-			if certPath, keyPath := viper.GetString("cert"), viper.GetString("key"); certPath != "" && keyPath != "" {
+			if certPath, keyPath := viper.GetString("cert"), viper.GetString("key"); certPath != "" && keyPath != "" && !memory {
 				systemCert, err = setupCerts(certPath, keyPath, viper.GetString("key-pass"))
 				if err != nil {
 					return err
 				}
 			}
 
+			var tokenManager manipulate.TokenManager
+			var issuer tokenIssuerFunc
+			if !memory {
+				issuer, err = newTokenIssuer(
+					viper.GetString("api-public"),
+					caPoolPublic,
+					systemCert,
+					tlsServerName("public"),
+					viper.GetBool("insecure-public"),
+					viper.GetString("token-creds"),
+					viper.GetString("vince-account"),
+					viper.GetString("vince-password"),
+					viper.GetBool("token-from-cert"),
+				)
+				if err != nil {
+					return err
+				}
+			}
+			if issuer != nil {
+				tokenManager = newSharedTokenManager(issuer, viper.GetDuration("token-validity"))
+			}
+
+			load, err := newLoadProfile(viper.GetString("rate"), viper.GetString("ramp"), viper.GetString("rate-steps"))
+			if err != nil {
+				return err
+			}
+
+			var transports []transportWrapper
+
+			if addr := viper.GetString("metrics-addr"); addr != "" {
+				stop, err := serveMetrics(addr)
+				if err != nil {
+					return fmt.Errorf("unable to start metrics server on '%s': %s", addr, err)
+				}
+				defer stop()
+
+				transports = append(transports, instrumentTransport)
+			}
+
+			endpoint := viper.GetString("otlp-endpoint")
+			if endpoint != "" {
+				stop, err := setupTracing(context.Background(), name, endpoint)
+				if err != nil {
+					return err
+				}
+				defer stop()
+			}
+
 			ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("limit"))
 			defer cancel()
 
 			suites := filterSuites()
 
-			var encoding elemental.EncodingType
-			switch viper.GetString("encoding") {
-			case "json":
+			encoding := elemental.EncodingTypeMSGPACK
+			if viper.GetString("encoding") == "json" {
 				encoding = elemental.EncodingTypeJSON
-			case "msgpack":
-				encoding = elemental.EncodingTypeMSGPACK
-			default:
-				zap.L().Fatal("Unknown encoding type", zap.String("encoding", viper.GetString("encoding")))
 			}
 
-			for _, suite := range suites {
-				err := newTestRunner(
-					ctx,
-					viper.GetString("build-id"),
-					viper.GetString("api-private"),
-					caPoolPrivate,
-					systemCert,
+			if viper.GetString("token") == "" && tokenManager == nil && !memory {
+				fmt.Println(goterm.Color("warning: no --token or token source given. Tests requiring the public api will be skipped", goterm.YELLOW))
+			}
 
-					viper.GetString("api-public"),
-					caPoolPublic,
-					viper.GetString("token"),
-					viper.GetString("namespace"),
-
-					suite,
-					viper.GetDuration("limit"),
-					viper.GetInt("concurrent"),
-					viper.GetInt("stress"),
-					viper.GetBool("verbose"),
-					viper.GetBool("skip-teardown"),
-					viper.GetBool("stop-on-failure"),
-					encoding,
-				).Run(ctx, suite)
+			if systemCert == nil && !memory {
+				fmt.Println(goterm.Color("warning: no --cert and --key given. Tests requiring the private api will be skipped", goterm.YELLOW))
+			}
+
+			cfg := testRunnerConfig{
+				buildID: viper.GetString("build-id"),
+
+				privateAPI:        viper.GetString("api-private"),
+				privateCAPool:     caPoolPrivate,
+				insecurePrivate:   viper.GetBool("insecure-private"),
+				privateServerName: tlsServerName("private"),
+				systemCert:        systemCert,
+
+				publicAPI:        viper.GetString("api-public"),
+				publicCAPool:     caPoolPublic,
+				insecurePublic:   viper.GetBool("insecure-public"),
+				publicServerName: tlsServerName("public"),
+				token:            viper.GetString("token"),
+				tokenManager:     tokenManager,
+				namespace:        viper.GetString("namespace"),
+
+				timeout:       viper.GetDuration("limit"),
+				concurrent:    viper.GetInt("concurrent"),
+				stress:        viper.GetInt("stress"),
+				soak:          viper.GetDuration("soak"),
+				soakInterval:  viper.GetDuration("soak-interval"),
+				load:          load,
+				verbose:       viper.GetBool("verbose"),
+				skipTeardown:  viper.GetBool("skip-teardown"),
+				stopOnFailure: viper.GetBool("stop-on-failure"),
+				encoding:      encoding,
+				backend:       viper.GetString("backend"),
+				transports:    transports,
+				traced:        endpoint != "",
+				captureHTTP:   viper.GetBool("capture-http"),
+				reproCommands: viper.GetInt("repro-commands"),
+				recordDir:     viper.GetString("record"),
+				replayDir:     viper.GetString("replay"),
+			}
+
+			for _, suite := range suites {
+				runner, err := newTestRunner(ctx, suite, cfg)
 				if err != nil {
 					return err
 				}
+
+				if err := runner.Run(ctx, suite); err != nil {
+					return err
+				}
 			}
 			return nil
 		},
 	}
 
-	defaultCaCertPrivate := ""
-	defaultCert := ""
-	defaultKey := ""
-	defaultCaCertPublic := ""
-	cf := os.Getenv("CERTS_FOLDER")
-	if cf != "" {
-		defaultCaCertPrivate = os.ExpandEnv("$CERTS_FOLDER/ca-chain-system.pem")
-		defaultCert = os.ExpandEnv("$CERTS_FOLDER/system-cert.pem")
-		defaultKey = os.ExpandEnv("$CERTS_FOLDER/system-key.pem")
-		defaultCaCertPublic = os.ExpandEnv("$CERTS_FOLDER/ca-chain-public.pem")
-	}
-	// Parameters to connect to private API
-	cmdRunTests.Flags().String("api-private", "https://127.0.0.1:4444", "Address of the private api gateway")
-	cmdRunTests.Flags().String("cacert-private", defaultCaCertPrivate, "Path to the private api ca certificate")
-	cmdRunTests.Flags().String("cert", defaultCert, "Path to client certificate")
-	cmdRunTests.Flags().String("key-pass", "", "Password for the certificate key")
-	cmdRunTests.Flags().String("key", defaultKey, "Path to client certificate key")
-
-	// Parameters to connect to public API
-	cmdRunTests.Flags().String("api-public", "https://127.0.0.1:4443", "Address of the public api gateway")
-	cmdRunTests.Flags().String("cacert-public", defaultCaCertPublic, "Path to the public api ca certificate")
-	cmdRunTests.Flags().String("token", "", "Access Token")
-	cmdRunTests.Flags().String("namespace", "/", "Account Name")
+	addConnectionFlags(cmdRunTests)
 
 	// Parameters to configure suite behaviors
 	cmdRunTests.Flags().StringSliceP("suite", "Z", nil, "Only run suites specified")
 
 	// Parameters to configure test behaviors
-	cmdRunTests.Flags().String("encoding", "msgpack", "Default encoding to use to talk to the API")
+	cmdRunTests.Flags().String("backend", backendHTTP, "Backend to run the tests against: http for the api gateways, or memory for an in-memory backend with no platform")
 	cmdRunTests.Flags().BoolP("verbose", "V", false, "Show logs even on success")
 	cmdRunTests.Flags().DurationP("limit", "l", 20*time.Minute, "Execution time limit")
 	cmdRunTests.Flags().IntP("concurrent", "c", 20, "Max number of concurrent tests")
 	cmdRunTests.Flags().IntP("stress", "s", 1, "Number of time to run each time in parallel")
+	cmdRunTests.Flags().Duration("soak", 0, "Keep running iterations of each test for the given duration instead of a fixed number. Only the logs of the last 10 failed iterations are kept")
+	cmdRunTests.Flags().Duration("soak-interval", time.Minute, "Interval between progress lines during a soak run")
+	cmdRunTests.Flags().String("rate", "", "Launch iterations of each test at a fixed rate (ex: 50/s)")
+	cmdRunTests.Flags().String("ramp", "", "Linearly ramp up the rate of iterations of each test (ex: '0->100 over 5m')")
+	cmdRunTests.Flags().String("rate-steps", "", "Launch iterations of each test at successive rates (ex: '10/s for 1m, 50/s for 2m')")
 	cmdRunTests.Flags().StringSliceP("id", "i", nil, "Only run tests with the given identifier")
 	cmdRunTests.Flags().StringSliceP("tag", "t", nil, "Only run tests with the given tags")
 	cmdRunTests.Flags().BoolP("match-all", "M", false, "Match all tags specified")
 	cmdRunTests.Flags().BoolP("skip-teardown", "S", false, "Skip teardown step")
 	cmdRunTests.Flags().BoolP("stop-on-failure", "X", false, "Stop on the first failed test")
+	cmdRunTests.Flags().String("metrics-addr", "", "Address to expose Prometheus metrics on while running (ex: :9090)")
+	cmdRunTests.Flags().Bool("capture-http", false, "Capture the HTTP requests of each iteration and show them with its log")
+	cmdRunTests.Flags().Int("repro-commands", 5, "Number of curl commands reproducing the last API calls to print for failed iterations (requires --capture-http)")
+	cmdRunTests.Flags().String("record", "", "Record the HTTP requests of each iteration and their responses in the given directory, per test id and iteration. Secrets and sensitive fields are redacted from the recordings")
+	cmdRunTests.Flags().String("replay", "", "Replay the responses recorded with --record in the given directory. Requests are answered in process instead of by the api. Push events are not recorded, so tests subscribing to them fail")
+	cmdRunTests.Flags().String("otlp-endpoint", "", "Export traces to the given OTLP HTTP collector (ex: http://localhost:4318) or file (ex: file:///tmp/traces.json)")
+
+	var cmdDoctor = &cobra.Command{
+		Use:           "doctor",
+		Aliases:       []string{"check-env"},
+		Short:         "Check the connectivity and the credentials used to run the tests",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return viper.BindPFlags(cmd.Flags())
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+
+			if err := checkConnectionArguments(); err != nil {
+				return err
+			}
+
+			RegisterSecrets(viper.GetString("token"), viper.GetString("key-pass"), viper.GetString("vince-password"))
+
+			encoding := elemental.EncodingTypeMSGPACK
+			if viper.GetString("encoding") == "json" {
+				encoding = elemental.EncodingTypeJSON
+			}
+
+			return runDoctor(context.Background(), doctorConfig{
+				privateAPI:        viper.GetString("api-private"),
+				privateCAPath:     viper.GetString("cacert-private"),
+				certPath:          viper.GetString("cert"),
+				keyPath:           viper.GetString("key"),
+				keyPass:           viper.GetString("key-pass"),
+				insecurePrivate:   viper.GetBool("insecure-private"),
+				privateServerName: tlsServerName("private"),
+				publicAPI:         viper.GetString("api-public"),
+				publicCAPath:      viper.GetString("cacert-public"),
+				insecurePublic:    viper.GetBool("insecure-public"),
+				publicServerName:  tlsServerName("public"),
+				token:             viper.GetString("token"),
+				tokenCredsPath:    viper.GetString("token-creds"),
+				vinceAccount:      viper.GetString("vince-account"),
+				vincePassword:     viper.GetString("vince-password"),
+				tokenFromCert:     viper.GetBool("token-from-cert"),
+				tokenValidity:     viper.GetDuration("token-validity"),
+				namespace:         viper.GetString("namespace"),
+				encoding:          encoding,
+				timeout:           viper.GetDuration("timeout"),
+			})
+		},
+	}
+
+	addConnectionFlags(cmdDoctor)
+	cmdDoctor.Flags().Duration("timeout", 10*time.Second, "Timeout of each check")
 
 	rootCmd.AddCommand(
 		versionCmd,
 		cmdListTests,
 		cmdRunTests,
+		cmdDoctor,
 	)
 
 	return rootCmd
 }
+
+// addConnectionFlags adds the flags used to connect to the apis to the given command.
+func addConnectionFlags(cmd *cobra.Command) {
+
+	defaultCaCertPrivate := ""
+	defaultCert := ""
+	defaultKey := ""
+	defaultCaCertPublic := ""
+	cf := os.Getenv("CERTS_FOLDER")
+	if cf != "" {
+		defaultCaCertPrivate = os.ExpandEnv("$CERTS_FOLDER/ca-chain-system.pem")
+		defaultCert = os.ExpandEnv("$CERTS_FOLDER/system-cert.pem")
+		defaultKey = os.ExpandEnv("$CERTS_FOLDER/system-key.pem")
+		defaultCaCertPublic = os.ExpandEnv("$CERTS_FOLDER/ca-chain-public.pem")
+	}
+	// Parameters to connect to private API
+	cmd.Flags().String("api-private", "https://127.0.0.1:4444", "Address of the private api gateway")
+	cmd.Flags().String("cacert-private", defaultCaCertPrivate, "Path to the private api ca certificate")
+	cmd.Flags().String("cert", defaultCert, "Path to client certificate")
+	cmd.Flags().String("key-pass", "", "Password for the certificate key")
+	cmd.Flags().String("key", defaultKey, "Path to client certificate key")
+	cmd.Flags().Bool("insecure-private", false, "Skip the verification of the private api server certificate")
+	cmd.Flags().String("tls-server-name-private", "", "Server name to use to verify the private api certificate instead of --tls-server-name")
+
+	// Parameters to connect to public API
+	cmd.Flags().String("api-public", "https://127.0.0.1:4443", "Address of the public api gateway")
+	cmd.Flags().String("cacert-public", defaultCaCertPublic, "Path to the public api ca certificate")
+	cmd.Flags().Bool("insecure-public", false, "Skip the verification of the public api server certificate")
+	cmd.Flags().String("tls-server-name-public", "", "Server name to use to verify the public api certificate instead of --tls-server-name")
+	cmd.Flags().String("tls-server-name", "", "Server name to use to verify the certificates of both the public and the private api when it differs from their address (ex: when using IP addresses)")
+	cmd.Flags().String("token", "", "Access Token")
+	cmd.Flags().String("token-creds", "", "Path to an app credential file to issue tokens from instead of --token")
+	cmd.Flags().String("vince-account", "", "Name of the vince account to issue tokens from instead of --token")
+	cmd.Flags().String("vince-password", "", "Password of the vince account")
+	cmd.Flags().Bool("token-from-cert", false, "Issue tokens from the client certificate instead of --token")
+	cmd.Flags().Duration("token-validity", time.Hour, "Validity of the issued tokens. They are renewed during longer runs")
+	cmd.Flags().String("namespace", "/", "Account Name")
+
+	cmd.Flags().String("encoding", "msgpack", "Default encoding to use to talk to the API")
+}
+
+// tlsServerName returns the server name to use to verify the certificate
+// of the given gateway, public or private, if it differs from its address.
+func tlsServerName(gateway string) string {
+
+	if name := viper.GetString("tls-server-name-" + gateway); name != "" {
+		return name
+	}
+
+	return viper.GetString("tls-server-name")
+}
+
 func setupPublicCA(caPublicPath string) (*x509.CertPool, error) {
 
 	pool, err := x509.SystemCertPool()
@@ -238,6 +444,113 @@ func setupCerts(certPath string, keyPath string, keyPass string) (*tls.Certifica
 	return &cert, nil
 }
 
+// checkConnectionArguments validates the flags added by addConnectionFlags.
+func checkConnectionArguments() error {
+
+	switch viper.GetString("encoding") {
+	case "json", "msgpack":
+	default:
+		return fmt.Errorf("invalid encoding '%s': must be json or msgpack", viper.GetString("encoding"))
+	}
+
+	for _, flag := range []string{"api-public", "api-private"} {
+
+		addr := viper.GetString(flag)
+		if addr == "" {
+			continue
+		}
+
+		u, err := url.Parse(addr)
+		if err != nil {
+			return fmt.Errorf("invalid --%s '%s': %s", flag, addr, err)
+		}
+
+		if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid --%s '%s': must be an url like https://host:port", flag, addr)
+		}
+	}
+
+	sources := 0
+	for _, flag := range []string{"token", "token-creds", "vince-account"} {
+		if viper.GetString(flag) != "" {
+			sources++
+		}
+	}
+	if viper.GetBool("token-from-cert") {
+		sources++
+	}
+
+	if sources > 1 {
+		return fmt.Errorf("only one of --token, --token-creds, --vince-account and --token-from-cert can be given")
+	}
+
+	if sources > 0 && viper.GetString("api-public") == "" {
+		return fmt.Errorf("a token is given but --api-public is empty")
+	}
+
+	if viper.GetString("vince-account") != "" && viper.GetString("vince-password") == "" {
+		return fmt.Errorf("--vince-account requires --vince-password")
+	}
+
+	if viper.GetDuration("token-validity") <= 0 {
+		return fmt.Errorf("--token-validity must be positive")
+	}
+
+	if (viper.GetString("cert") == "") != (viper.GetString("key") == "") {
+		return fmt.Errorf("--cert and --key must be given together")
+	}
+
+	if viper.GetString("cert") != "" && viper.GetString("api-private") == "" {
+		return fmt.Errorf("--cert is given but --api-private is empty")
+	}
+
+	return nil
+}
+
+// checkTestArguments validates the arguments of the test command.
+func checkTestArguments() error {
+
+	switch viper.GetString("backend") {
+	case backendHTTP:
+		if err := checkConnectionArguments(); err != nil {
+			return err
+		}
+	case backendMemory:
+		if viper.GetString("record") != "" || viper.GetString("replay") != "" {
+			return fmt.Errorf("--record and --replay cannot be used with the %s backend", backendMemory)
+		}
+	default:
+		return fmt.Errorf("invalid backend '%s': must be %s or %s", viper.GetString("backend"), backendHTTP, backendMemory)
+	}
+
+	if viper.GetString("record") != "" && viper.GetString("replay") != "" {
+		return fmt.Errorf("--record and --replay cannot be used together")
+	}
+
+	if viper.GetInt("concurrent") <= 0 {
+		return fmt.Errorf("--concurrent must be greater than 0")
+	}
+
+	if viper.GetInt("stress") <= 0 {
+		return fmt.Errorf("--stress must be greater than 0")
+	}
+
+	if viper.GetDuration("limit") <= 0 {
+		return fmt.Errorf("--limit must be positive")
+	}
+
+	if soak := viper.GetDuration("soak"); soak > 0 {
+		if soak >= viper.GetDuration("limit") {
+			return fmt.Errorf("soak duration '%s' must be lower than the execution time limit '%s'. Use --limit to increase it", soak, viper.GetDuration("limit"))
+		}
+		if viper.GetDuration("soak-interval") <= 0 {
+			return fmt.Errorf("soak interval must be positive")
+		}
+	}
+
+	return nil
+}
+
 // runSuite returns true if we should consider the suite for running
 func runSuite(s *suiteInfo, names []string) bool {
 	if len(names) == 0 {
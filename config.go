@@ -0,0 +1,51 @@
+package apocheck
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// loadConfig loads the given configuration file. Its keys are the names
+// of the flags, and flags given on the command line take precedence.
+// If profile is set, the keys of the section profiles.<profile>
+// override the top level ones.
+func loadConfig(path string, profile string) error {
+
+	if path == "" {
+		if profile != "" {
+			return fmt.Errorf("--profile '%s' requires --config", profile)
+		}
+		return nil
+	}
+
+	viper.SetConfigFile(path)
+	if err := viper.ReadInConfig(); err != nil {
+		return fmt.Errorf("unable to read config file '%s': %s", path, err)
+	}
+
+	if profile == "" {
+		return nil
+	}
+
+	profiles := viper.GetStringMap("profiles")
+
+	values, ok := profiles[strings.ToLower(profile)].(map[string]interface{})
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		return fmt.Errorf("unknown profile '%s' in config file '%s'. Available profiles: %s", profile, path, strings.Join(names, ", "))
+	}
+
+	if err := viper.MergeConfigMap(values); err != nil {
+		return fmt.Errorf("unable to apply profile '%s': %s", profile, err)
+	}
+
+	return nil
+}
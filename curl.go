@@ -0,0 +1,103 @@
+package apocheck
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"go.aporeto.io/elemental"
+)
+
+// Environment variables used as placeholders in reproduction commands.
+const (
+	reproTokenEnv  = "APOCHECK_TOKEN"
+	reproCertEnv   = "APOCHECK_CERT"
+	reproKeyEnv    = "APOCHECK_KEY"
+	reproCACertEnv = "APOCHECK_CACERT"
+)
+
+// reproSkippedHeaders are the headers not included in reproduction commands.
+var reproSkippedHeaders = map[string]struct{}{
+	"Authorization":   {},
+	"Cookie":          {},
+	"Content-Length":  {},
+	"Accept-Encoding": {},
+	"Traceparent":     {},
+	"Tracestate":      {},
+}
+
+// curlCommand returns a curl command reproducing the given exchange.
+// The token is replaced by a reference to an environment variable.
+// The body is the captured one, so msgpack bodies are sent as JSON, and
+// redacted and truncated values must be filled in.
+func curlCommand(e *httpExchange) string {
+
+	header := e.header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+
+	if strings.Contains(header.Get("Content-Type"), "msgpack") || strings.Contains(header.Get("Accept"), "msgpack") {
+		header.Set("Content-Type", string(elemental.EncodingTypeJSON))
+		header.Set("Accept", string(elemental.EncodingTypeJSON))
+	}
+
+	lines := []string{
+		fmt.Sprintf("curl -X %s %s", e.method, shellQuote(e.url)),
+		fmt.Sprintf("--cacert \"$%s\"", reproCACertEnv),
+	}
+
+	if auth := e.header.Get("Authorization"); auth != "" {
+		scheme := strings.SplitN(auth, " ", 2)[0]
+		lines = append(lines, fmt.Sprintf("-H \"Authorization: %s $%s\"", scheme, reproTokenEnv))
+	} else {
+		lines = append(lines, fmt.Sprintf("--cert \"$%s\" --key \"$%s\"", reproCertEnv, reproKeyEnv))
+	}
+
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		if _, ok := reproSkippedHeaders[http.CanonicalHeaderKey(k)]; ok {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, v := range header[k] {
+			lines = append(lines, fmt.Sprintf("-H %s", shellQuote(k+": "+v)))
+		}
+	}
+
+	if e.requestBody != "" {
+		lines = append(lines, fmt.Sprintf("--data-binary %s", shellQuote(e.requestBody)))
+	}
+
+	return strings.Join(lines, " \\\n  ")
+}
+
+// formatReproCommands returns the curl commands reproducing
+// the last n given exchanges.
+func formatReproCommands(exchanges []*httpExchange, n int, indent string) string {
+
+	if n <= 0 || len(exchanges) == 0 {
+		return ""
+	}
+
+	if len(exchanges) > n {
+		exchanges = exchanges[len(exchanges)-n:]
+	}
+
+	b := &strings.Builder{}
+	for _, e := range exchanges {
+		fmt.Fprintf(b, "%s%s\n\n", indent, strings.Replace(curlCommand(e), "\n", "\n"+indent, -1)) // nolint
+	}
+
+	return b.String()
+}
+
+// shellQuote quotes the given string for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
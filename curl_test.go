@@ -0,0 +1,129 @@
+package apocheck
+
+import (
+	"net/http"
+	"testing"
+)
+
+func Test_shellQuote(t *testing.T) {
+
+	tests := []struct {
+		name string
+		s    string
+		want string
+	}{
+		{"empty", "", `''`},
+		{"simple", "hello", `'hello'`},
+		{"spaces", "hello world", `'hello world'`},
+		{"variable", "$HOME", `'$HOME'`},
+		{"single quote", "it's", `'it'\''s'`},
+		{"double quote", `say "hi"`, `'say "hi"'`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shellQuote(tt.s); got != tt.want {
+				t.Errorf("shellQuote() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_curlCommand(t *testing.T) {
+
+	tests := []struct {
+		name string
+		e    *httpExchange
+		want string
+	}{
+		{
+			"get with token",
+			&httpExchange{
+				method: http.MethodGet,
+				url:    "https://api.example.com/namespaces?q=name == 'a'",
+				header: http.Header{
+					"Authorization":   {"Bearer abcdef"},
+					"Accept":          {"application/json"},
+					"Accept-Encoding": {"gzip"},
+					"Traceparent":     {"00-abc-def-01"},
+					"X-Namespace":     {"/ns"},
+				},
+			},
+			"curl -X GET 'https://api.example.com/namespaces?q=name == '\\''a'\\''' \\\n" +
+				"  --cacert \"$APOCHECK_CACERT\" \\\n" +
+				"  -H \"Authorization: Bearer $APOCHECK_TOKEN\" \\\n" +
+				"  -H 'Accept: application/json' \\\n" +
+				"  -H 'X-Namespace: /ns'",
+		},
+		{
+			"post with certificate",
+			&httpExchange{
+				method: http.MethodPost,
+				url:    "https://api.example.com/issue",
+				header: http.Header{
+					"Content-Type":   {"application/json"},
+					"Content-Length": {"42"},
+					"Cookie":         {"session=abc"},
+				},
+				requestBody: formatBody([]byte(`{"name":"a","password":"secret","apiKey":"abc"}`), "application/json"),
+			},
+			"curl -X POST 'https://api.example.com/issue' \\\n" +
+				"  --cacert \"$APOCHECK_CACERT\" \\\n" +
+				"  --cert \"$APOCHECK_CERT\" --key \"$APOCHECK_KEY\" \\\n" +
+				"  -H 'Content-Type: application/json' \\\n" +
+				"  --data-binary '{\"name\":\"a\",\"password\":\"<redacted>\",\"apiKey\":\"<redacted>\"}'",
+		},
+		{
+			"no header",
+			&httpExchange{
+				method: http.MethodDelete,
+				url:    "https://api.example.com/namespaces/1",
+			},
+			"curl -X DELETE 'https://api.example.com/namespaces/1' \\\n" +
+				"  --cacert \"$APOCHECK_CACERT\" \\\n" +
+				"  --cert \"$APOCHECK_CERT\" --key \"$APOCHECK_KEY\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := curlCommand(tt.e); got != tt.want {
+				t.Errorf("curlCommand() = \n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_formatReproCommands(t *testing.T) {
+
+	exchanges := []*httpExchange{
+		{method: http.MethodGet, url: "https://api.example.com/a"},
+		{method: http.MethodGet, url: "https://api.example.com/b"},
+	}
+
+	tests := []struct {
+		name      string
+		exchanges []*httpExchange
+		n         int
+		want      string
+	}{
+		{"none", nil, 1, ""},
+		{"disabled", exchanges, 0, ""},
+		{
+			"last",
+			exchanges,
+			1,
+			"  curl -X GET 'https://api.example.com/b' \\\n" +
+				"    --cacert \"$APOCHECK_CACERT\" \\\n" +
+				"    --cert \"$APOCHECK_CERT\" --key \"$APOCHECK_KEY\"\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatReproCommands(tt.exchanges, tt.n, "  "); got != tt.want {
+				t.Errorf("formatReproCommands() = \n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
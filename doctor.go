@@ -0,0 +1,367 @@
+package apocheck
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/buger/goterm"
+	"go.aporeto.io/elemental"
+	"go.aporeto.io/gaia"
+	"go.aporeto.io/manipulate"
+	"go.aporeto.io/manipulate/maniphttp"
+	"go.aporeto.io/tg/tglib"
+)
+
+// doctorExpiryWarning is the remaining validity under which
+// the doctor warns about a certificate or a token.
+const doctorExpiryWarning = 24 * time.Hour
+
+type doctorStatus int
+
+const (
+	doctorOK doctorStatus = iota
+	doctorWarning
+	doctorFailed
+	doctorSkipped
+)
+
+// A doctor checks the environment tests run against and reports
+// the result of each check.
+type doctor struct {
+	timeout  time.Duration
+	failures int
+}
+
+func (d *doctor) report(status doctorStatus, check string, format string, args ...interface{}) {
+
+	var label string
+	var color int
+
+	switch status {
+	case doctorOK:
+		label, color = "[ OK ]", goterm.GREEN
+	case doctorWarning:
+		label, color = "[WARN]", goterm.YELLOW
+	case doctorFailed:
+		label, color = "[FAIL]", goterm.RED
+		d.failures++
+	case doctorSkipped:
+		label, color = "[SKIP]", goterm.BLUE
+	}
+
+	fmt.Println(mainRedactor.redact(fmt.Sprintf("%s %s: %s", goterm.Color(label, color), check, fmt.Sprintf(format, args...))))
+}
+
+// A doctorConfig holds the parameters of the doctor,
+// which are the ones of the tests.
+type doctorConfig struct {
+	privateAPI        string
+	privateCAPath     string
+	certPath          string
+	keyPath           string
+	keyPass           string
+	insecurePrivate   bool
+	privateServerName string
+
+	publicAPI        string
+	publicCAPath     string
+	insecurePublic   bool
+	publicServerName string
+
+	token          string
+	tokenCredsPath string
+	vinceAccount   string
+	vincePassword  string
+	tokenFromCert  bool
+	tokenValidity  time.Duration
+
+	namespace string
+	encoding  elemental.EncodingType
+	timeout   time.Duration
+}
+
+// runDoctor checks the CA files, the client certificate, the connectivity
+// to the gateways, the token and the push channel using the same parameters
+// as the tests. It returns an error if any of the checks failed.
+func runDoctor(ctx context.Context, cfg doctorConfig) error {
+
+	d := &doctor{timeout: cfg.timeout}
+
+	// CAs
+	var publicCAPool, privateCAPool *x509.CertPool
+	var err error
+
+	if cfg.publicCAPath == "" {
+		d.report(doctorOK, "public ca", "no --cacert-public given, using the system roots")
+	} else if publicCAPool, err = setupPublicCA(cfg.publicCAPath); err != nil {
+		d.report(doctorFailed, "public ca", "unable to load '%s': %s", cfg.publicCAPath, err)
+	} else {
+		d.report(doctorOK, "public ca", "loaded from '%s'", cfg.publicCAPath)
+	}
+
+	if cfg.insecurePublic {
+		d.report(doctorWarning, "public ca", "--insecure-public is set, the server certificate will not be verified")
+	}
+
+	if cfg.privateCAPath == "" {
+		d.report(doctorOK, "private ca", "no --cacert-private given, using the system roots")
+	} else if privateCAPool, err = setupPrivateCA(cfg.privateCAPath); err != nil {
+		d.report(doctorFailed, "private ca", "unable to load '%s': %s", cfg.privateCAPath, err)
+	} else {
+		d.report(doctorOK, "private ca", "loaded from '%s'", cfg.privateCAPath)
+	}
+
+	if cfg.insecurePrivate {
+		d.report(doctorWarning, "private ca", "--insecure-private is set, the server certificate will not be verified")
+	}
+
+	// Client certificate
+	var systemCert *tls.Certificate
+	if cfg.certPath == "" || cfg.keyPath == "" {
+		d.report(doctorSkipped, "client certificate", "no --cert and --key given")
+	} else {
+		systemCert = d.checkCertificate(cfg.certPath, cfg.keyPath, cfg.keyPass)
+	}
+
+	// Private gateway
+	var rootManipulator manipulate.Manipulator
+	if systemCert == nil || cfg.privateAPI == "" {
+		d.report(doctorSkipped, "private api", "no valid client certificate")
+	} else {
+		tlsConfig := newTLSConfig(cfg.privateAPI, privateCAPool, []tls.Certificate{*systemCert}, cfg.privateServerName, cfg.insecurePrivate, "private")
+		rootManipulator = d.checkAPI(ctx, "private api", cfg.privateAPI, cfg.namespace, tlsConfig, cfg.encoding, "")
+	}
+
+	// Token source
+	token := cfg.token
+	issued := token == ""
+	if issued {
+		token = d.issueToken(ctx, cfg, publicCAPool, systemCert)
+	}
+
+	// Token and public gateway
+	var publicManipulator manipulate.Manipulator
+	if token == "" || cfg.publicAPI == "" {
+		d.report(doctorSkipped, "token", "no token given")
+		d.report(doctorSkipped, "public api", "no token given")
+	} else {
+		d.checkToken(token, cfg.namespace, issued)
+
+		tlsConfig := newTLSConfig(cfg.publicAPI, publicCAPool, nil, cfg.publicServerName, cfg.insecurePublic, "public")
+		publicManipulator = d.checkAPI(ctx, "public api", cfg.publicAPI, cfg.namespace, tlsConfig, cfg.encoding, token)
+	}
+
+	// Push channel
+	switch {
+	case publicManipulator != nil:
+		d.checkPush(ctx, "push channel (public api)", publicManipulator)
+	case rootManipulator != nil:
+		d.checkPush(ctx, "push channel (private api)", rootManipulator)
+	default:
+		d.report(doctorSkipped, "push channel", "no reachable api")
+	}
+
+	if d.failures > 0 {
+		return fmt.Errorf("%d checks failed", d.failures)
+	}
+
+	return nil
+}
+
+// checkCertificate checks the client certificate and its key and
+// returns it if they are usable.
+func (d *doctor) checkCertificate(certPath string, keyPath string, keyPass string) *tls.Certificate {
+
+	x509Cert, key, err := tglib.ReadCertificatePEM(certPath, keyPath, keyPass)
+	if err != nil {
+		d.report(doctorFailed, "client certificate", "unable to read '%s' and '%s': %s", certPath, keyPath, err)
+		return nil
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		d.report(doctorFailed, "client certificate", "unsupported key type %T", key)
+		return nil
+	}
+
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(x509Cert.PublicKey) {
+		d.report(doctorFailed, "client certificate", "the key '%s' does not match the certificate '%s'", keyPath, certPath)
+		return nil
+	}
+
+	now := time.Now()
+	switch {
+	case now.Before(x509Cert.NotBefore):
+		d.report(doctorFailed, "client certificate", "'%s' is not valid before %s", x509Cert.Subject.CommonName, x509Cert.NotBefore)
+		return nil
+	case now.After(x509Cert.NotAfter):
+		d.report(doctorFailed, "client certificate", "'%s' expired on %s", x509Cert.Subject.CommonName, x509Cert.NotAfter)
+		return nil
+	case x509Cert.NotAfter.Sub(now) < doctorExpiryWarning:
+		d.report(doctorWarning, "client certificate", "'%s' expires on %s", x509Cert.Subject.CommonName, x509Cert.NotAfter)
+	default:
+		d.report(doctorOK, "client certificate", "'%s' valid until %s", x509Cert.Subject.CommonName, x509Cert.NotAfter)
+	}
+
+	cert, err := tglib.ToTLSCertificate(x509Cert, key)
+	if err != nil {
+		d.report(doctorFailed, "client certificate", "unable to convert to a tls certificate: %s", err)
+		return nil
+	}
+
+	return &cert
+}
+
+// issueToken issues a token from the configured token source, if any.
+func (d *doctor) issueToken(ctx context.Context, cfg doctorConfig, publicCAPool *x509.CertPool, systemCert *tls.Certificate) string {
+
+	issuer, err := newTokenIssuer(cfg.publicAPI, publicCAPool, systemCert, cfg.publicServerName, cfg.insecurePublic, cfg.tokenCredsPath, cfg.vinceAccount, cfg.vincePassword, cfg.tokenFromCert)
+	if err != nil {
+		d.report(doctorFailed, "token source", "%s", err)
+		return ""
+	}
+
+	if issuer == nil {
+		return ""
+	}
+
+	subctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	token, err := newSharedTokenManager(issuer, cfg.tokenValidity).Issue(subctx)
+	if err != nil {
+		d.report(doctorFailed, "token source", "%s", err)
+		return ""
+	}
+
+	d.report(doctorOK, "token source", "issued a token valid for %s", cfg.tokenValidity)
+
+	return token
+}
+
+// checkAPI connects to the given api and counts the namespaces
+// to validate the connection and the credentials. It returns the
+// manipulator if the api is reachable.
+func (d *doctor) checkAPI(
+	ctx context.Context,
+	check string,
+	api string,
+	namespace string,
+	tlsConfig *tls.Config,
+	encoding elemental.EncodingType,
+	token string,
+) manipulate.Manipulator {
+
+	options := append(
+		httpOptions(tlsConfig, nil),
+		maniphttp.OptionNamespace(namespace),
+		maniphttp.OptionEncoding(encoding),
+	)
+	if token != "" {
+		options = append(options, maniphttp.OptionToken(token))
+	}
+
+	subctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	m, err := maniphttp.New(ctx, api, options...)
+	if err != nil {
+		d.report(doctorFailed, check, "unable to connect to '%s': %s", api, err)
+		return nil
+	}
+
+	start := time.Now()
+	if _, err := m.Count(manipulate.NewContext(subctx), gaia.NamespaceIdentity); err != nil {
+		d.report(doctorFailed, check, "unable to list namespaces in '%s' on '%s': %s", namespace, api, err)
+		return nil
+	}
+
+	d.report(doctorOK, check, "'%s' reachable in %s", api, time.Since(start).Round(time.Millisecond))
+
+	return m
+}
+
+// tokenClaims are the claims of a token checked by the doctor.
+type tokenClaims struct {
+	Issuer       string `json:"iss"`
+	Subject      string `json:"sub"`
+	Realm        string `json:"realm"`
+	ExpiresAt    int64  `json:"exp"`
+	Restrictions struct {
+		Namespace string `json:"namespace"`
+	} `json:"restrictions"`
+}
+
+// checkToken checks the claims of the given token. The
+// signature is verified by the api in checkAPI. The expiry
+// of the tokens issued by the doctor is not warned about,
+// as they are renewed during runs.
+func (d *doctor) checkToken(token string, namespace string, issued bool) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		d.report(doctorFailed, "token", "not a valid jwt")
+		return
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		d.report(doctorFailed, "token", "unable to decode claims: %s", err)
+		return
+	}
+
+	claims := tokenClaims{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		d.report(doctorFailed, "token", "unable to decode claims: %s", err)
+		return
+	}
+
+	if rns := claims.Restrictions.Namespace; rns != "" && rns != "/" && namespace != rns && !strings.HasPrefix(namespace, rns+"/") {
+		d.report(doctorFailed, "token", "restricted to namespace '%s' which does not contain --namespace '%s'", rns, namespace)
+		return
+	}
+
+	desc := fmt.Sprintf("realm: %s, subject: %s, issuer: %s", claims.Realm, claims.Subject, claims.Issuer)
+
+	if claims.ExpiresAt == 0 {
+		d.report(doctorOK, "token", "%s, no expiration", desc)
+		return
+	}
+
+	exp := time.Unix(claims.ExpiresAt, 0)
+	switch remaining := time.Until(exp); {
+	case remaining <= 0:
+		d.report(doctorFailed, "token", "%s, expired on %s", desc, exp)
+	case issued:
+		// Issued tokens are only valid for --token-validity,
+		// and are renewed during the runs.
+		d.report(doctorOK, "token", "%s, valid until %s, renewed during runs", desc, exp)
+	case remaining < doctorExpiryWarning:
+		d.report(doctorWarning, "token", "%s, expires in %s", desc, remaining.Round(time.Second))
+	default:
+		d.report(doctorOK, "token", "%s, valid until %s", desc, exp)
+	}
+}
+
+// checkPush checks the push channel can be connected to.
+func (d *doctor) checkPush(ctx context.Context, check string, m manipulate.Manipulator) {
+
+	subctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := startSubscriber(subctx, m, nil); err != nil {
+		d.report(doctorFailed, check, "%s", err)
+		return
+	}
+
+	d.report(doctorOK, check, "connected in %s", time.Since(start).Round(time.Millisecond))
+}
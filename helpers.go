@@ -12,13 +12,23 @@ import (
 	midgardclient "go.aporeto.io/midgard-lib/client"
 )
 
+// replayToken is the token used instead of the issued ones when replaying.
+const replayToken = "replay"
+
+// testAccountPassword is the password of the accounts created by CreateTestAccount.
+const testAccountPassword = "Euphrates123#"
+
 // Cleanup function is a type function.
 type Cleanup func() error
 
 // CreateTestAccount creates an account using the given TestInfo and returns an authenticated manipulator.
 func CreateTestAccount(ctx context.Context, m manipulate.Manipulator, t TestInfo) (manipulate.Manipulator, *gaia.Account, Cleanup, error) {
 
-	account := t.Account("Euphrates123#")
+	// The password is the same for all the accounts, so it is
+	// only added to the redacted secrets the first time.
+	t.RegisterSecret(testAccountPassword)
+
+	account := t.Account(testAccountPassword)
 	account.AccessEnabled = true
 
 	return CreateAccount(ctx, m, account, t)
@@ -38,6 +48,8 @@ func CreateTestNamespace(ctx context.Context, m manipulate.Manipulator, t TestIn
 }
 
 // CreateAccount creates the given gaia.Account and returns a manipulator for this account.
+// The password of the account is not redacted from the output: register it with
+// TestInfo.RegisterSecret if needed, but avoid registering a new one per iteration.
 func CreateAccount(ctx context.Context, m manipulate.Manipulator, account *gaia.Account, t TestInfo) (manipulate.Manipulator, *gaia.Account, Cleanup, error) {
 
 	// Keep a ref as Create qwill reset it.
@@ -47,21 +59,36 @@ func CreateAccount(ctx context.Context, m manipulate.Manipulator, account *gaia.
 		return nil, nil, nil, err
 	}
 
-	token, err := midgardclient.NewClientWithTLS(t.publicAPI, t.publicTLSConfig).IssueFromVince(ctx, account.Name, password, "", t.Timeout())
-	if err != nil {
-		return nil, nil, nil, err
+	cleanUpfunc := func() error { return m.Delete(nil, account) }
+
+	// There is no authentication with the memory backend.
+	if t.memory != nil {
+		return t.memory, account, cleanUpfunc, nil
 	}
 
-	accountManipulator, _ := maniphttp.New(
+	// When replaying, the requests are answered from the recording,
+	// which does not hold the Authorization header, so no token is needed.
+	token := replayToken
+	if !t.replaying {
+		var err error
+		if token, err = midgardclient.NewClientWithTLS(t.publicAPI, t.publicTLSConfig).IssueFromVince(ctx, account.Name, password, "", t.Timeout()); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	accountManipulator, err := maniphttp.New(
 		ctx,
 		t.publicAPI,
-		maniphttp.OptionToken(token),
-		maniphttp.OptionEncoding(t.encoding),
-		maniphttp.OptionNamespace("/"+account.Name),
-		maniphttp.OptionTLSConfig(t.publicTLSConfig),
+		append(
+			httpOptions(t.publicTLSConfig, t.transports),
+			maniphttp.OptionToken(token),
+			maniphttp.OptionEncoding(t.encoding),
+			maniphttp.OptionNamespace("/"+account.Name),
+		)...,
 	)
-
-	cleanUpfunc := func() error { return m.Delete(nil, account) }
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("unable to create manipulator for account '%s': %s", account.Name, err)
+	}
 
 	return accountManipulator, account, cleanUpfunc, nil
 }
@@ -0,0 +1,277 @@
+package apocheck
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pacerIdleInterval is the maximum time to wait before checking
+// the rate of a load profile again, so a launch is not delayed by
+// the low rate seen at the previous check.
+const pacerIdleInterval = 100 * time.Millisecond
+
+// A loadProfile gives the number of iterations per second
+// to launch after the given elapsed time.
+type loadProfile interface {
+	rate(elapsed time.Duration) float64
+}
+
+// fixedRateProfile launches iterations at a constant rate.
+type fixedRateProfile struct {
+	perSecond float64
+}
+
+func (p fixedRateProfile) rate(time.Duration) float64 {
+	return p.perSecond
+}
+
+// rampProfile linearly increases or decreases the rate
+// from a value to another over the given duration,
+// then keeps the final rate.
+type rampProfile struct {
+	from float64
+	to   float64
+	over time.Duration
+}
+
+func (p rampProfile) rate(elapsed time.Duration) float64 {
+
+	if elapsed >= p.over {
+		return p.to
+	}
+
+	return p.from + (p.to-p.from)*float64(elapsed)/float64(p.over)
+}
+
+// loadStep is a rate held for a duration.
+type loadStep struct {
+	perSecond float64
+	duration  time.Duration
+}
+
+// stepProfile holds successive rates for their duration,
+// then keeps the last rate.
+type stepProfile struct {
+	steps []loadStep
+}
+
+func (p stepProfile) rate(elapsed time.Duration) float64 {
+
+	for _, s := range p.steps {
+		if elapsed < s.duration {
+			return s.perSecond
+		}
+		elapsed -= s.duration
+	}
+
+	return p.steps[len(p.steps)-1].perSecond
+}
+
+// newLoadProfile returns the load profile described by the given
+// flag values. At most one of them can be set. It returns nil if
+// none is set.
+func newLoadProfile(rate string, ramp string, steps string) (loadProfile, error) {
+
+	var set int
+	for _, v := range []string{rate, ramp, steps} {
+		if v != "" {
+			set++
+		}
+	}
+
+	if set > 1 {
+		return nil, fmt.Errorf("only one of --rate, --ramp and --rate-steps can be set")
+	}
+
+	switch {
+
+	case rate != "":
+		r, err := parseRate(rate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate '%s': %s", rate, err)
+		}
+		if r == 0 {
+			return nil, fmt.Errorf("invalid rate '%s': rate must be positive", rate)
+		}
+		return fixedRateProfile{perSecond: r}, nil
+
+	case ramp != "":
+		p, err := parseRamp(ramp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ramp '%s': %s", ramp, err)
+		}
+		return p, nil
+
+	case steps != "":
+		p, err := parseSteps(steps)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate steps '%s': %s", steps, err)
+		}
+		return p, nil
+	}
+
+	return nil, nil
+}
+
+// parseRate parses a rate like 50/s, 100/m or 5/100ms and returns
+// it as a number of iterations per second. A rate without unit is
+// per second.
+func parseRate(s string) (float64, error) {
+
+	parts := strings.SplitN(strings.TrimSpace(s), "/", 2)
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number of iterations: %s", err)
+	}
+
+	if n < 0 {
+		return 0, fmt.Errorf("number of iterations must be positive")
+	}
+
+	if len(parts) == 1 {
+		return n, nil
+	}
+
+	unit := strings.TrimSpace(parts[1])
+	if unit != "" && (unit[0] < '0' || unit[0] > '9') {
+		unit = "1" + unit
+	}
+
+	d, err := time.ParseDuration(unit)
+	if err != nil {
+		return 0, fmt.Errorf("invalid unit: %s", err)
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("unit must be positive")
+	}
+
+	return n / d.Seconds(), nil
+}
+
+// parseRamp parses a ramp like '0->100 over 5m'. The final rate
+// must be positive as it is kept once the ramp is over.
+func parseRamp(s string) (rampProfile, error) {
+
+	parts := strings.SplitN(s, " over ", 2)
+	if len(parts) != 2 {
+		return rampProfile{}, fmt.Errorf("must be in the form '<from>-><to> over <duration>'")
+	}
+
+	rates := strings.SplitN(parts[0], "->", 2)
+	if len(rates) != 2 {
+		return rampProfile{}, fmt.Errorf("must be in the form '<from>-><to> over <duration>'")
+	}
+
+	from, err := parseRate(rates[0])
+	if err != nil {
+		return rampProfile{}, err
+	}
+
+	to, err := parseRate(rates[1])
+	if err != nil {
+		return rampProfile{}, err
+	}
+
+	if to == 0 {
+		return rampProfile{}, fmt.Errorf("final rate must be positive")
+	}
+
+	over, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return rampProfile{}, err
+	}
+
+	if over <= 0 {
+		return rampProfile{}, fmt.Errorf("duration must be positive")
+	}
+
+	return rampProfile{from: from, to: to, over: over}, nil
+}
+
+// parseSteps parses steps like '10/s for 1m, 50/s for 2m'. The rate
+// of the last step must be positive as it is kept once the steps are
+// over.
+func parseSteps(s string) (stepProfile, error) {
+
+	p := stepProfile{}
+
+	for _, item := range strings.Split(s, ",") {
+
+		parts := strings.SplitN(item, " for ", 2)
+		if len(parts) != 2 {
+			return stepProfile{}, fmt.Errorf("must be in the form '<rate> for <duration>, ...'")
+		}
+
+		r, err := parseRate(parts[0])
+		if err != nil {
+			return stepProfile{}, err
+		}
+
+		d, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return stepProfile{}, err
+		}
+
+		if d <= 0 {
+			return stepProfile{}, fmt.Errorf("duration must be positive")
+		}
+
+		p.steps = append(p.steps, loadStep{perSecond: r, duration: d})
+	}
+
+	if p.steps[len(p.steps)-1].perSecond == 0 {
+		return stepProfile{}, fmt.Errorf("rate of the last step must be positive")
+	}
+
+	return p, nil
+}
+
+// A pacer schedules iteration launches according to a load profile.
+// An iteration is launched once the time since the last launch reaches
+// the interval given by the current rate.
+type pacer struct {
+	profile loadProfile
+	start   time.Time
+	last    time.Time
+}
+
+func newPacer(profile loadProfile) *pacer {
+	return &pacer{
+		profile: profile,
+		start:   time.Now(),
+	}
+}
+
+// wait blocks until the next iteration can be launched.
+func (p *pacer) wait(ctx context.Context) error {
+
+	for {
+
+		now := time.Now()
+
+		d := pacerIdleInterval
+		if rate := p.profile.rate(now.Sub(p.start)); rate > 0 {
+			remaining := 1/rate - now.Sub(p.last).Seconds()
+			if remaining <= 0 {
+				p.last = now
+				return nil
+			}
+			if remaining < d.Seconds() {
+				d = time.Duration(remaining * float64(time.Second))
+			}
+		}
+
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
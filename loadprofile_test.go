@@ -0,0 +1,259 @@
+package apocheck
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_parseRate(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		s       string
+		want    float64
+		wantErr bool
+	}{
+		{"per second", "50/s", 50, false},
+		{"per minute", "120/m", 2, false},
+		{"per duration", "5/100ms", 50, false},
+		{"per hour with number", "3600/1h", 1, false},
+		{"no unit", "10", 10, false},
+		{"spaces", " 10 / s ", 10, false},
+		{"fraction", "0.5/s", 0.5, false},
+		{"zero", "0/s", 0, false},
+		{"negative", "-1/s", 0, true},
+		{"not a number", "a/s", 0, true},
+		{"empty", "", 0, true},
+		{"invalid unit", "10/x", 0, true},
+		{"empty unit", "10/", 0, true},
+		{"zero unit", "10/0s", 0, true},
+		{"negative unit", "10/-1s", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRate(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseRate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseRamp(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		s       string
+		want    rampProfile
+		wantErr bool
+	}{
+		{"ramp up", "0->100 over 5m", rampProfile{from: 0, to: 100, over: 5 * time.Minute}, false},
+		{"ramp down", "10/s->1/s over 1m", rampProfile{from: 10, to: 1, over: time.Minute}, false},
+		{"per minute", "60/m -> 120/m over 30s", rampProfile{from: 1, to: 2, over: 30 * time.Second}, false},
+		{"no duration", "0->100", rampProfile{}, true},
+		{"no arrow", "100 over 5m", rampProfile{}, true},
+		{"invalid from", "x->100 over 5m", rampProfile{}, true},
+		{"invalid to", "0->x over 5m", rampProfile{}, true},
+		{"invalid duration", "0->100 over x", rampProfile{}, true},
+		{"zero duration", "0->100 over 0s", rampProfile{}, true},
+		{"ramp down to zero", "10->0 over 1m", rampProfile{}, true},
+		{"negative duration", "0->100 over -1m", rampProfile{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRamp(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRamp() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseRamp() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseSteps(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		s       string
+		want    stepProfile
+		wantErr bool
+	}{
+		{
+			"single",
+			"10/s for 1m",
+			stepProfile{steps: []loadStep{{perSecond: 10, duration: time.Minute}}},
+			false,
+		},
+		{
+			"several",
+			"10/s for 1m, 50/s for 2m,120/m for 30s",
+			stepProfile{steps: []loadStep{
+				{perSecond: 10, duration: time.Minute},
+				{perSecond: 50, duration: 2 * time.Minute},
+				{perSecond: 2, duration: 30 * time.Second},
+			}},
+			false,
+		},
+		{
+			"zero step",
+			"0/s for 1m, 10/s for 1m",
+			stepProfile{steps: []loadStep{
+				{perSecond: 0, duration: time.Minute},
+				{perSecond: 10, duration: time.Minute},
+			}},
+			false,
+		},
+		{"zero last step", "10/s for 1m, 0/s for 1m", stepProfile{}, true},
+		{"no duration", "10/s", stepProfile{}, true},
+		{"empty step", "10/s for 1m,", stepProfile{}, true},
+		{"invalid rate", "x for 1m", stepProfile{}, true},
+		{"invalid duration", "10/s for x", stepProfile{}, true},
+		{"zero duration", "10/s for 0s", stepProfile{}, true},
+		{"negative duration", "10/s for -1m", stepProfile{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSteps(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSteps() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSteps() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newLoadProfile(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		rate    string
+		ramp    string
+		steps   string
+		want    loadProfile
+		wantErr bool
+	}{
+		{"none", "", "", "", nil, false},
+		{"rate", "50/s", "", "", fixedRateProfile{perSecond: 50}, false},
+		{"ramp", "", "0->10 over 1m", "", rampProfile{from: 0, to: 10, over: time.Minute}, false},
+		{"steps", "", "", "1/s for 1m", stepProfile{steps: []loadStep{{perSecond: 1, duration: time.Minute}}}, false},
+		{"several", "50/s", "0->10 over 1m", "", nil, true},
+		{"zero rate", "0/s", "", "", nil, true},
+		{"zero rate without unit", "0", "", "", nil, true},
+		{"invalid rate", "x", "", "", nil, true},
+		{"invalid ramp", "", "x", "", nil, true},
+		{"invalid steps", "", "", "x", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newLoadProfile(tt.rate, tt.ramp, tt.steps)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newLoadProfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newLoadProfile() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_loadProfileRate(t *testing.T) {
+
+	ramp := rampProfile{from: 0, to: 100, over: 10 * time.Second}
+	steps := stepProfile{steps: []loadStep{
+		{perSecond: 1, duration: time.Minute},
+		{perSecond: 5, duration: time.Minute},
+	}}
+
+	tests := []struct {
+		name    string
+		profile loadProfile
+		elapsed time.Duration
+		want    float64
+	}{
+		{"fixed", fixedRateProfile{perSecond: 3}, time.Hour, 3},
+		{"ramp start", ramp, 0, 0},
+		{"ramp middle", ramp, 5 * time.Second, 50},
+		{"ramp end", ramp, 10 * time.Second, 100},
+		{"after ramp", ramp, time.Hour, 100},
+		{"ramp down", rampProfile{from: 10, to: 0, over: 10 * time.Second}, 2 * time.Second, 8},
+		{"first step", steps, 0, 1},
+		{"second step", steps, time.Minute, 5},
+		{"after steps", steps, time.Hour, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.profile.rate(tt.elapsed); got != tt.want {
+				t.Errorf("rate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_pacer(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		profile  loadProfile
+		duration time.Duration
+		min      int
+		max      int
+	}{
+		{"fixed", fixedRateProfile{perSecond: 50}, time.Second, 45, 51},
+		{"zero", fixedRateProfile{perSecond: 0}, 300 * time.Millisecond, 0, 0},
+		// 0 to 100/s over 2s launches about 100 iterations,
+		// and must not stall on the low rate at the start.
+		{"ramp from zero", rampProfile{from: 0, to: 100, over: 2 * time.Second}, 2 * time.Second, 85, 105},
+		// 1 launch in the first step, then about 50.
+		{"step after low step", stepProfile{steps: []loadStep{
+			{perSecond: 0.5, duration: time.Second},
+			{perSecond: 50, duration: time.Second},
+		}}, 2 * time.Second, 40, 53},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.duration)
+			defer cancel()
+
+			p := newPacer(tt.profile)
+
+			var launches int
+			for p.wait(ctx) == nil {
+				launches++
+			}
+
+			if launches < tt.min || launches > tt.max {
+				t.Errorf("pacer launched %d iterations, want between %d and %d", launches, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func Test_pacerCanceled(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p := newPacer(fixedRateProfile{perSecond: 0})
+
+	if err := p.wait(ctx); err != context.Canceled {
+		t.Errorf("wait() error = %v, want %v", err, context.Canceled)
+	}
+}
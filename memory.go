@@ -0,0 +1,188 @@
+package apocheck
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.aporeto.io/elemental"
+	"go.aporeto.io/manipulate"
+	"go.aporeto.io/manipulate/manipmemory"
+)
+
+const (
+	// backendHTTP runs the tests against the api gateways.
+	backendHTTP = "http"
+
+	// backendMemory runs the tests against an in-memory backend.
+	backendMemory = "memory"
+)
+
+// memorySubscriberBufferSize is the number of events an in-memory
+// subscriber buffers before dropping the new ones.
+const memorySubscriberBufferSize = 1000
+
+// A memoryBackend is an in-memory manipulator emitting push
+// events to in-process subscribers, used to run the tests
+// without a platform. Namespaces are not isolated.
+type memoryBackend struct {
+	subscribers map[*memorySubscriber]struct{}
+	lock        sync.RWMutex
+
+	manipulate.TransactionalManipulator
+}
+
+// newMemoryBackend returns a memoryBackend storing all
+// the identities of the given model manager.
+func newMemoryBackend(manager elemental.ModelManager) (*memoryBackend, error) {
+
+	schemas := map[string]*manipmemory.IdentitySchema{}
+	for _, identity := range manager.AllIdentities() {
+		schemas[identity.Category] = &manipmemory.IdentitySchema{
+			Identity: identity,
+			Indexes: []*manipmemory.Index{
+				{
+					Name:      "id",
+					Type:      manipmemory.IndexTypeString,
+					Unique:    true,
+					Attribute: "ID",
+				},
+			},
+		}
+	}
+
+	m, err := manipmemory.New(schemas)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create memory backend: %s", err)
+	}
+
+	return &memoryBackend{
+		subscribers:              map[*memorySubscriber]struct{}{},
+		TransactionalManipulator: m,
+	}, nil
+}
+
+// Create creates the given object and emits a create event.
+func (b *memoryBackend) Create(mctx manipulate.Context, object elemental.Identifiable) error {
+
+	if err := b.TransactionalManipulator.Create(mctx, object); err != nil {
+		return err
+	}
+
+	b.emit(elemental.EventCreate, object)
+
+	return nil
+}
+
+// Update updates the given object and emits an update event.
+func (b *memoryBackend) Update(mctx manipulate.Context, object elemental.Identifiable) error {
+
+	if err := b.TransactionalManipulator.Update(mctx, object); err != nil {
+		return err
+	}
+
+	b.emit(elemental.EventUpdate, object)
+
+	return nil
+}
+
+// Delete deletes the given object and emits a delete event.
+func (b *memoryBackend) Delete(mctx manipulate.Context, object elemental.Identifiable) error {
+
+	if err := b.TransactionalManipulator.Delete(mctx, object); err != nil {
+		return err
+	}
+
+	b.emit(elemental.EventDelete, object)
+
+	return nil
+}
+
+func (b *memoryBackend) emit(eventType elemental.EventType, object elemental.Identifiable) {
+
+	evt := elemental.NewEvent(eventType, object)
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for s := range b.subscribers {
+		s.publish(evt)
+	}
+}
+
+func (b *memoryBackend) newSubscriber() *memorySubscriber {
+	return &memorySubscriber{
+		backend: b,
+		events:  make(chan *elemental.Event, memorySubscriberBufferSize),
+		errors:  make(chan error, 1),
+		status:  make(chan manipulate.SubscriberStatus, 2),
+	}
+}
+
+// A memorySubscriber is a manipulate.Subscriber
+// receiving the events of a memoryBackend.
+type memorySubscriber struct {
+	backend    *memoryBackend
+	pushConfig *elemental.PushConfig
+	events     chan *elemental.Event
+	errors     chan error
+	status     chan manipulate.SubscriberStatus
+	lock       sync.RWMutex
+}
+
+// Start starts receiving the events until the given context is canceled.
+func (s *memorySubscriber) Start(ctx context.Context, pushConfig *elemental.PushConfig) {
+
+	s.UpdateFilter(pushConfig)
+
+	s.backend.lock.Lock()
+	s.backend.subscribers[s] = struct{}{}
+	s.backend.lock.Unlock()
+
+	s.status <- manipulate.SubscriberStatusInitialConnection
+
+	go func() {
+		<-ctx.Done()
+
+		s.backend.lock.Lock()
+		delete(s.backend.subscribers, s)
+		s.backend.lock.Unlock()
+
+		select {
+		case s.status <- manipulate.SubscriberStatusFinalDisconnection:
+		default:
+		}
+	}()
+}
+
+// UpdateFilter updates the push config filtering the events.
+func (s *memorySubscriber) UpdateFilter(pushConfig *elemental.PushConfig) {
+	s.lock.Lock()
+	s.pushConfig = pushConfig
+	s.lock.Unlock()
+}
+
+// Events returns the events channel.
+func (s *memorySubscriber) Events() chan *elemental.Event { return s.events }
+
+// Errors returns the errors channel.
+func (s *memorySubscriber) Errors() chan error { return s.errors }
+
+// Status returns the status channel.
+func (s *memorySubscriber) Status() chan manipulate.SubscriberStatus { return s.status }
+
+func (s *memorySubscriber) publish(evt *elemental.Event) {
+
+	s.lock.RLock()
+	pushConfig := s.pushConfig
+	s.lock.RUnlock()
+
+	if pushConfig != nil && pushConfig.IsFilteredOut(evt.Identity, evt.Type) {
+		return
+	}
+
+	select {
+	case s.events <- evt:
+	default:
+	}
+}
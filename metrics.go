@@ -0,0 +1,215 @@
+package apocheck
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds the metrics exposed by --metrics-addr.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	metricIterationsStarted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "apocheck_test_iterations_started_total",
+			Help: "Number of test iterations started.",
+		},
+		[]string{"suite", "tag"},
+	)
+
+	metricIterationsPassed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "apocheck_test_iterations_passed_total",
+			Help: "Number of test iterations passed.",
+		},
+		[]string{"suite", "tag"},
+	)
+
+	metricIterationsFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "apocheck_test_iterations_failed_total",
+			Help: "Number of test iterations failed.",
+		},
+		[]string{"suite", "tag"},
+	)
+
+	metricIterationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "apocheck_test_iteration_duration_seconds",
+			Help:    "Duration of the test iterations.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 16),
+		},
+		[]string{"suite", "test"},
+	)
+
+	metricIterationsInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "apocheck_test_iterations_in_flight",
+			Help: "Number of test iterations currently running.",
+		},
+		[]string{"suite"},
+	)
+
+	metricPushEventsReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "apocheck_push_events_received_total",
+			Help: "Number of push events received.",
+		},
+		[]string{"identity", "type"},
+	)
+
+	metricAPICalls = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "apocheck_api_calls_total",
+			Help: "Number of API calls made by the manipulators.",
+		},
+		[]string{"identity", "operation", "code"},
+	)
+
+	metricAPICallDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "apocheck_api_call_duration_seconds",
+			Help:    "Duration of the API calls made by the manipulators.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"identity", "operation"},
+	)
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		metricIterationsStarted,
+		metricIterationsPassed,
+		metricIterationsFailed,
+		metricIterationDuration,
+		metricIterationsInFlight,
+		metricPushEventsReceived,
+		metricAPICalls,
+		metricAPICallDuration,
+	)
+}
+
+// serveMetrics starts serving the metrics on the given address.
+// It returns a function to stop the server.
+func serveMetrics(addr string) (func(), error) {
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go server.Serve(ln) // nolint
+
+	return func() { server.Close() }, nil // nolint
+}
+
+// suiteLabel returns the suite label of the given test.
+func suiteLabel(t Test) string {
+
+	if t.SuiteName == "" {
+		return "none"
+	}
+
+	return t.SuiteName
+}
+
+// recordIterationStart records the start of an iteration of the given test.
+func recordIterationStart(t Test) {
+
+	suite := suiteLabel(t)
+
+	metricIterationsInFlight.WithLabelValues(suite).Inc()
+	for _, tag := range t.Tags {
+		metricIterationsStarted.WithLabelValues(suite, tag).Inc()
+	}
+}
+
+// recordIterationEnd records the result of an iteration of the given test.
+func recordIterationEnd(t Test, duration time.Duration, err error) {
+
+	suite := suiteLabel(t)
+
+	metricIterationsInFlight.WithLabelValues(suite).Dec()
+	metricIterationDuration.WithLabelValues(suite, t.Name).Observe(duration.Seconds())
+
+	counter := metricIterationsPassed
+	if err != nil {
+		counter = metricIterationsFailed
+	}
+
+	for _, tag := range t.Tags {
+		counter.WithLabelValues(suite, tag).Inc()
+	}
+}
+
+// instrumentTransport is a transportWrapper recording
+// the count and latency of the API calls.
+func instrumentTransport(next http.RoundTripper) http.RoundTripper {
+
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+
+		identity, operation := apiOperation(req)
+
+		start := time.Now()
+		resp, err := next.RoundTrip(req)
+		metricAPICallDuration.WithLabelValues(identity, operation).Observe(time.Since(start).Seconds())
+
+		code := "error"
+		if err == nil {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		metricAPICalls.WithLabelValues(identity, operation, code).Inc()
+
+		return resp, err
+	})
+}
+
+// apiOperation returns the identity category and the manipulate
+// operation targeted by the given request.
+func apiOperation(req *http.Request) (identity string, operation string) {
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	hasID := len(parts)%2 == 0
+
+	identity = parts[len(parts)-1]
+	if hasID {
+		identity = parts[len(parts)-2]
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		operation = "retrieve-many"
+		if hasID {
+			operation = "retrieve"
+		}
+	case http.MethodPost:
+		operation = "create"
+	case http.MethodPut:
+		operation = "update"
+	case http.MethodDelete:
+		operation = "delete-many"
+		if hasID {
+			operation = "delete"
+		}
+	case http.MethodHead:
+		operation = "count"
+	default:
+		operation = strings.ToLower(req.Method)
+	}
+
+	return identity, operation
+}
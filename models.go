@@ -0,0 +1,77 @@
+package apocheck
+
+import (
+	"fmt"
+
+	"go.aporeto.io/elemental"
+	"go.aporeto.io/gaia"
+)
+
+// mainModelManager is the model manager used to decode push events.
+// It can be changed with CommandOptionModelManager.
+var mainModelManager elemental.ModelManager = gaia.Manager()
+
+// A RawIdentifiable holds the content of a push event whose
+// identity is not known by the model manager.
+type RawIdentifiable struct {
+	Data map[string]interface{}
+
+	identity elemental.Identity
+}
+
+// Identity returns the identity of the event.
+func (o *RawIdentifiable) Identity() elemental.Identity {
+	return o.identity
+}
+
+// Identifier returns the value of the ID field, if any.
+func (o *RawIdentifiable) Identifier() string {
+
+	for _, k := range []string{"ID", "id"} {
+		if id, ok := o.Data[k].(string); ok {
+			return id
+		}
+	}
+
+	return ""
+}
+
+// SetIdentifier sets the value of the ID field.
+func (o *RawIdentifiable) SetIdentifier(id string) {
+
+	if o.Data == nil {
+		o.Data = map[string]interface{}{}
+	}
+
+	o.Data["ID"] = id
+}
+
+// Version returns 1.
+func (o *RawIdentifiable) Version() int {
+	return 1
+}
+
+// decodeEvent decodes the object of the given event using the given
+// model manager. If the identity of the event is not known by the
+// manager, the object is decoded in a RawIdentifiable.
+func decodeEvent(manager elemental.ModelManager, evt *elemental.Event) (elemental.Identity, elemental.Identifiable, error) {
+
+	identity := manager.IdentityFromName(evt.Identity)
+
+	if !identity.IsEmpty() {
+		if obj := manager.Identifiable(identity); obj != nil {
+			if err := evt.Decode(obj); err != nil {
+				return identity, nil, fmt.Errorf("unable to decode '%s' event for '%s': %s", evt.Type, evt.Identity, err)
+			}
+			return identity, obj, nil
+		}
+	}
+
+	identity = elemental.Identity{Name: evt.Identity}
+	raw := &RawIdentifiable{identity: identity}
+	if err := evt.Decode(&raw.Data); err != nil {
+		return identity, nil, fmt.Errorf("unable to decode '%s' event for '%s': %s", evt.Type, evt.Identity, err)
+	}
+
+	return identity, raw, nil
+}
@@ -37,18 +37,44 @@ func printSetupError(id, suite, name string, recovery interface{}, err error) {
 	fmt.Println()
 
 	if recovery != nil {
-		fmt.Println("panic:", recovery)
+		fmt.Println("panic:", mainRedactor.redact(fmt.Sprint(recovery)))
 		fmt.Println(string(debug.Stack()))
 	}
 
 	if err != nil {
-		fmt.Println(goterm.Color(fmt.Sprintf("  error: %s", err), goterm.RED))
+		fmt.Println(goterm.Color(fmt.Sprintf("  error: %s", mainRedactor.redact(err.Error())), goterm.RED))
 	}
 
 	fmt.Println()
 }
 
-func createHeader(currTest testRun, results []testResult, showOnSuccess bool) (failed bool) {
+func printSkipped(test Test, missing []Capability) {
+
+	printLock.Lock()
+	defer printLock.Unlock()
+
+	names := make([]string, len(missing))
+	for i, c := range missing {
+		names[i] = c.String()
+	}
+
+	fmt.Println(
+		goterm.Color(
+			fmt.Sprintf("SKIP (%s): %s %s/%s",
+				test.id,
+				test.SuiteName,
+				test.Name,
+				goterm.Color(fmt.Sprintf("missing: %s", strings.Join(names, ", ")), goterm.BLUE),
+			),
+			goterm.CYAN,
+		),
+	)
+}
+
+// createHeader writes the header of the report of the given results. If
+// soak is not nil, the statistics come from it rather than from the
+// results, which then only hold the iterations whose logs are printed.
+func createHeader(currTest testRun, results []testResult, soak *soakSummary, showOnSuccess bool) (failed bool) {
 
 	failed = hasErrors(results)
 
@@ -62,17 +88,48 @@ func createHeader(currTest testRun, results []testResult, showOnSuccess bool) (f
 		sname = currTest.test.SuiteName
 	}
 
+	var iterations, leaks, leakedIterations int
+	var stats durationStats
+	var histogram string
+	var latencies map[string]durationStats
+
+	if soak != nil {
+		iterations = soak.iterations
+		stats = soak.durations.stats()
+		histogram = soak.durations.format("  ")
+		latencies = soak.pushLatencyStats()
+		leaks, leakedIterations = soak.leaks, soak.leakedIterations
+	} else {
+		durations := resultDurations(results)
+		iterations = len(results)
+		stats = computeStats(durations)
+		histogram = formatHistogram(durations, "  ")
+		latencies = pushLatencyStats(results)
+		leaks, leakedIterations = countLeaks(results)
+	}
+
+	avg := stats.mean.Round(time.Millisecond)
+
 	if !failed && !showOnSuccess {
+		timing := fmt.Sprintf("avg: %s", avg)
+		if iterations > 1 {
+			timing = fmt.Sprintf("%s, %s", timing, stats)
+		}
+
 		output := goterm.Color(
 			fmt.Sprintf("%s (%s): %s %s/%s",
 				resultString,
 				currTest.test.id,
 				currTest.test.SuiteName,
 				currTest.test.Name,
-				goterm.Color(fmt.Sprintf("it: %d, avg: %s, suite: %s", len(results), averageTime(results), sname), goterm.BLUE),
+				goterm.Color(fmt.Sprintf("it: %d, %s, suite: %s", iterations, timing, sname), goterm.BLUE),
 			),
 			goterm.GREEN,
 		)
+		if latencies := formatPushLatencies(latencies, "  "); latencies != "" {
+			output += "\n" + strings.TrimSuffix(latencies, "\n")
+		}
+		output += formatLeaks(leaks, leakedIterations)
 		currTest.testInfo.WriteHeader([]byte(output)) // nolint
 		return failed
 	}
@@ -97,16 +154,33 @@ func createHeader(currTest testRun, results []testResult, showOnSuccess bool) (f
 			120,
 		),
 	)
+
+	if iterations > 1 {
+		output += goterm.Color(fmt.Sprintf("it: %d, avg: %s, %s", iterations, avg, stats), goterm.BLUE) + "\n"
+		output += histogram
+	}
+
+	output += formatPushLatencies(latencies, "")
+	output += formatLeaks(leaks, leakedIterations)
+
 	currTest.testInfo.WriteHeader([]byte(output)) // nolint
 	return failed
 }
 
-func appendResults(run testRun, results []testResult, showOnSuccess bool) {
+func appendResults(run testRun, results []testResult, soak *soakSummary, showOnSuccess bool) {
 
 	printLock.Lock()
 	defer printLock.Unlock()
 
-	failed := createHeader(run, results, showOnSuccess)
+	if soak != nil {
+		results = soak.failedResults()
+	}
+
+	failed := createHeader(run, results, soak, showOnSuccess)
+
+	if soak != nil && soak.failures > len(results) {
+		run.testInfo.Write([]byte(goterm.Color(fmt.Sprintf("\nOnly the logs of the last %d of the %d failed iterations are kept", len(results), soak.failures), goterm.MAGENTA) + "\n")) // nolint
+	}
 
 	for _, result := range results {
 		output := ""
@@ -127,7 +201,32 @@ func appendResults(run testRun, results []testResult, showOnSuccess bool) {
 			output += fmt.Sprintf("  <no log>\n")
 		}
 
+		if len(result.exchanges) > 0 {
+			output += goterm.Color("  http:", goterm.MAGENTA) + "\n"
+			output += formatExchanges(result.exchanges, "    ")
+		}
+
+		if result.err != nil && run.reproCommands > 0 && len(result.exchanges) > 0 {
+			output += goterm.Color(
+				fmt.Sprintf("  reproduce (set $%s, $%s, $%s and $%s, and fill in the redacted and truncated values):", reproTokenEnv, reproCACertEnv, reproCertEnv, reproKeyEnv),
+				goterm.MAGENTA,
+			) + "\n"
+			output += formatReproCommands(result.exchanges, run.reproCommands, "    ")
+		}
+
+		if len(result.leakedSubscribers) > 0 {
+			output += goterm.Color(fmt.Sprintf("  push subscribers left open: %s", strings.Join(result.leakedSubscribers, ", ")), goterm.YELLOW) + "\n"
+		}
+
+		if len(result.steps) > 0 {
+			output += goterm.Color("  steps:", goterm.MAGENTA) + "\n"
+			output += formatSteps(result.steps, "    ")
+		}
+
 		if failed {
+			if path := failedStepPath(result.steps); len(path) > 0 {
+				output += fmt.Sprintf("%s\n", goterm.Color(fmt.Sprintf("  failed step: %s", strings.Join(path, " > ")), goterm.RED))
+			}
 			output += fmt.Sprintf("%s\n", goterm.Color(fmt.Sprintf("  error: %s", result.err), goterm.RED))
 		}
 
@@ -138,14 +237,66 @@ func appendResults(run testRun, results []testResult, showOnSuccess bool) {
 	}
 }
 
-func averageTime(results []testResult) time.Duration {
+// printSoakProgress prints the number of iterations and errors since the
+// start of the soak run, and the p99 of the iterations done in the last
+// interval.
+func printSoakProgress(run testRun, soak *soakSummary, interval time.Duration) {
+
+	printLock.Lock()
+	defer printLock.Unlock()
+
+	var rate float64
+	if soak.iterations > 0 {
+		rate = float64(soak.failures) / float64(soak.iterations) * 100
+	}
+
+	window := soak.flushWindow()
+
+	fmt.Println(
+		goterm.Color(
+			fmt.Sprintf("SOAK (%s): %s/%s it: %d, errors: %d (%.2f%%), last %s: it: %d, p99: %s",
+				run.test.id,
+				run.test.SuiteName,
+				run.test.Name,
+				soak.iterations,
+				soak.failures,
+				rate,
+				interval,
+				window.count,
+				window.p99.Round(time.Millisecond),
+			),
+			goterm.BLUE,
+		),
+	)
+}
+
+// countLeaks returns the number of push subscribers left
+// open by the given results and the number of iterations
+// that left them.
+func countLeaks(results []testResult) (leaks int, iterations int) {
 
-	var total int
 	for _, r := range results {
-		total += int(r.duration)
+		if len(r.leakedSubscribers) > 0 {
+			leaks += len(r.leakedSubscribers)
+			iterations++
+		}
 	}
 
-	return time.Duration(total / len(results)).Round(1 * time.Millisecond).Round(time.Millisecond)
+	return leaks, iterations
+}
+
+// formatLeaks returns a warning if some iterations
+// left push subscribers open.
+func formatLeaks(leaks int, iterations int) string {
+
+	if leaks == 0 {
+		return ""
+	}
+
+	return "\n" + goterm.Color(
+		fmt.Sprintf("  warning: %d push subscribers left open by %d iterations. They have been closed at the end of the iteration", leaks, iterations),
+		goterm.YELLOW,
+	)
 }
 
 func hasErrors(results []testResult) bool {
@@ -3,19 +3,28 @@ package apocheck
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/smartystreets/goconvey/convey"
 	"go.aporeto.io/elemental"
-	"go.aporeto.io/gaia"
 	"go.aporeto.io/manipulate"
 	"go.aporeto.io/manipulate/maniphttp"
 )
 
 type assertPushConfig struct {
 	subscriberOptions    []maniphttp.SubscriberOption
+	namespace            string
+	recursive            bool
+	pushConfig           *elemental.PushConfig
+	serverFilter         bool
 	additionalFilterFunc func(evt *elemental.Event) bool
 	assertEventFunc      func(event *elemental.Event, identifiable elemental.Identifiable) error
+	assertEventsFunc     func(events []*elemental.Event, identifiables elemental.IdentifiablesList) error
+	atLeast              bool
+	modelManager         elemental.ModelManager
+	measureLatency       bool
+	latency              *time.Duration
 	positiveTimeout      time.Duration
 	negativeTimeout      time.Duration
 }
@@ -24,9 +33,49 @@ func newAssertPushConfig() assertPushConfig {
 	return assertPushConfig{
 		positiveTimeout: 120 * time.Second,
 		negativeTimeout: 3 * time.Second,
+		modelManager:    mainModelManager,
 	}
 }
 
+// subscription returns the push config and the subscriber
+// options to subscribe to the given expectations with.
+func (cfg assertPushConfig) subscription(expectations ...PushExpectation) (*elemental.PushConfig, []maniphttp.SubscriberOption) {
+
+	options := append([]maniphttp.SubscriberOption{}, cfg.subscriberOptions...)
+	if cfg.namespace != "" {
+		options = append(options, maniphttp.SubscriberOptionNamespace(cfg.namespace))
+	}
+	if cfg.recursive {
+		options = append(options, maniphttp.SubscriberOptionRecursive(true))
+	}
+
+	pushConfig := cfg.pushConfig
+	if !cfg.serverFilter {
+		return pushConfig, options
+	}
+
+	if pushConfig == nil {
+		pushConfig = elemental.NewPushConfig()
+	} else {
+		pushConfig = pushConfig.Duplicate()
+	}
+
+	var names []string
+	types := map[string][]elemental.EventType{}
+	for _, e := range expectations {
+		if _, ok := types[e.Identity.Name]; !ok {
+			names = append(names, e.Identity.Name)
+		}
+		types[e.Identity.Name] = append(types[e.Identity.Name], e.Type)
+	}
+
+	for _, name := range names {
+		pushConfig.FilterIdentity(name, types[name]...)
+	}
+
+	return pushConfig, options
+}
+
 // An AssertPushOption represents options to push assertion functions.
 type AssertPushOption func(*assertPushConfig)
 
@@ -38,6 +87,43 @@ func AssertPushOptionEventAsserter(asserter func(event *elemental.Event, identif
 	}
 }
 
+// AssertPushOptionEventsAsserter sets the function to run to validate
+// all the matching events and their content in AssertPushCount.
+func AssertPushOptionEventsAsserter(asserter func(events []*elemental.Event, identifiables elemental.IdentifiablesList) error) func(cfg *assertPushConfig) {
+	return func(cfg *assertPushConfig) {
+		cfg.assertEventsFunc = asserter
+	}
+}
+
+// AssertPushOptionAtLeast makes AssertPushCount accept more
+// matching events than expected.
+func AssertPushOptionAtLeast() func(cfg *assertPushConfig) {
+	return func(cfg *assertPushConfig) {
+		cfg.atLeast = true
+	}
+}
+
+// AssertPushOptionModelManager sets the model manager used to decode
+// the events. Default is the one set with CommandOptionModelManager,
+// or the gaia one. Events whose identity is not known by the manager
+// are decoded in a RawIdentifiable.
+func AssertPushOptionModelManager(manager elemental.ModelManager) func(cfg *assertPushConfig) {
+	return func(cfg *assertPushConfig) {
+		cfg.modelManager = manager
+	}
+}
+
+// AssertPushOptionLatency makes AssertPush measure the time between the
+// call of the returned outer function, which arms the assertion, and the
+// receipt of the event. It is stored in latency if not nil, and the
+// latencies are aggregated per identity in the report.
+func AssertPushOptionLatency(latency *time.Duration) func(cfg *assertPushConfig) {
+	return func(cfg *assertPushConfig) {
+		cfg.measureLatency = true
+		cfg.latency = latency
+	}
+}
+
 // AssertPushOptionAdditionalFilter sets an additional filter
 // to basic elemental.Identity and elemental.EventType matching.
 // If it returns false, the push assertion function continues to wait.
@@ -55,6 +141,39 @@ func AssertPushOptionSubscriberOptions(options ...maniphttp.SubscriberOption) fu
 	}
 }
 
+// AssertPushOptionNamespace sets the namespace to subscribe to.
+// Default is the namespace of the manipulator.
+func AssertPushOptionNamespace(namespace string) func(cfg *assertPushConfig) {
+	return func(cfg *assertPushConfig) {
+		cfg.namespace = namespace
+	}
+}
+
+// AssertPushOptionRecursive makes the subscription receive
+// the events of the child namespaces too.
+func AssertPushOptionRecursive(recursive bool) func(cfg *assertPushConfig) {
+	return func(cfg *assertPushConfig) {
+		cfg.recursive = recursive
+	}
+}
+
+// AssertPushOptionPushConfig sets the elemental.PushConfig sent to
+// the server to filter the events of the subscription.
+func AssertPushOptionPushConfig(pushConfig *elemental.PushConfig) func(cfg *assertPushConfig) {
+	return func(cfg *assertPushConfig) {
+		cfg.pushConfig = pushConfig
+	}
+}
+
+// AssertPushOptionServerFilter makes the server only send the events
+// of the expected identities and types, instead of filtering them
+// on the client. It is combined with AssertPushOptionPushConfig if set.
+func AssertPushOptionServerFilter() func(cfg *assertPushConfig) {
+	return func(cfg *assertPushConfig) {
+		cfg.serverFilter = true
+	}
+}
+
 // AssertPushOptionPositiveTimeout sets the time to wait for a push assertion
 // that should find a push.Default is 10s.
 func AssertPushOptionPositiveTimeout(timeout time.Duration) func(cfg *assertPushConfig) {
@@ -88,42 +207,74 @@ func AssertPush(
 
 	subctx, cancel := context.WithTimeout(ctx, cfg.positiveTimeout)
 
-	evtch := make(chan *elemental.Event)
-	err := ListenForPushEvent(
+	expectation := PushExpectation{Identity: identity, Type: eventType, Filter: cfg.additionalFilterFunc}
+	pushConfig, subscriberOptions := cfg.subscription(expectation)
+
+	// The events are timestamped when received rather than
+	// when read to measure the latency.
+	var receivedLock sync.Mutex
+	received := map[*elemental.Event]time.Time{}
+
+	listener, err := ListenForPush(
 		subctx,
+		t,
 		m,
 		func(evt *elemental.Event) bool {
-			if evt.Identity != identity.Name || evt.Type != eventType {
+			if !expectation.matches(evt) {
 				return false
 			}
-			if cfg.additionalFilterFunc != nil {
-				if !cfg.additionalFilterFunc(evt) {
-					return false
-				}
+			if cfg.measureLatency {
+				receivedLock.Lock()
+				received[evt] = time.Now()
+				receivedLock.Unlock()
 			}
 			return true
 		},
-		evtch,
-		cfg.subscriberOptions...,
+		pushConfig,
+		subscriberOptions...,
 	)
 
 	Assert(t, fmt.Sprintf("connecting to events channel for '%s' event for '%s' should work", eventType, identity.Name), err, convey.ShouldBeNil)
 
 	return func() func() error {
 
+		armed := time.Now()
+
 		return func() error {
 			defer cancel()
+			defer listener.Close()
 
 			var evt *elemental.Event
+			var ok bool
 
 			select {
-			case evt = <-evtch:
+			case evt, ok = <-listener.Events():
 			case <-subctx.Done():
+			}
+
+			if !ok {
 				return fmt.Errorf("did not receive a '%s' event for '%s' in time", eventType, identity.Name)
 			}
 
-			obj := gaia.Manager().Identifiable(identity)
-			if err := evt.Decode(obj); err != nil {
+			if cfg.measureLatency {
+				receivedLock.Lock()
+				latency := received[evt].Sub(armed)
+				receivedLock.Unlock()
+
+				// The event can be received before the
+				// assertion is armed if armed late.
+				if latency < 0 {
+					latency = 0
+				}
+
+				t.pushLatencies.record(identity.Name, latency)
+				if cfg.latency != nil {
+					*cfg.latency = latency
+				}
+			}
+
+			_, obj, err := decodeEvent(cfg.modelManager, evt)
+			if err != nil {
 				return err
 			}
 
@@ -136,6 +287,272 @@ func AssertPush(
 	}
 }
 
+// AssertPushCount asserts exactly n matching pushes are received within the
+// positive timeout, using a single subscription. Once n pushes are received,
+// it waits for the negative timeout to make sure no other one follows, unless
+// AssertPushOptionAtLeast is set.
+func AssertPushCount(
+	ctx context.Context,
+	t TestInfo,
+	m manipulate.Manipulator,
+	identity elemental.Identity,
+	eventType elemental.EventType,
+	n int,
+	options ...AssertPushOption,
+) func() func() error {
+
+	cfg := newAssertPushConfig()
+	for _, opt := range options {
+		opt(&cfg)
+	}
+
+	expectation := PushExpectation{
+		Identity: identity,
+		Type:     eventType,
+		Filter:   cfg.additionalFilterFunc,
+	}
+
+	subctx, cancel := context.WithTimeout(ctx, cfg.positiveTimeout+cfg.negativeTimeout)
+
+	pushConfig, subscriberOptions := cfg.subscription(expectation)
+	recorder, err := newPushRecorder(subctx, t, m, cfg.modelManager, pushConfig, subscriberOptions...)
+
+	Assert(t, fmt.Sprintf("connecting to events channel for '%s' events for '%s' should work", eventType, identity.Name), err, convey.ShouldBeNil)
+
+	return func() func() error {
+
+		return func() error {
+			defer cancel()
+			defer recorder.Stop()
+
+			start := time.Now()
+			if err := recorder.wait(cfg.positiveTimeout, func(events []PushEvent) error {
+				if count := countMatching(events, expectation); count < n {
+					return fmt.Errorf("received %d '%s' events for '%s' in time, expected %d", count, eventType, identity.Name, n)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			if !cfg.atLeast {
+				if err := recorder.wait(cfg.negativeTimeout, func(events []PushEvent) error {
+					if countMatching(events, expectation) > n {
+						return nil
+					}
+					return errNoExtraPush
+				}); err == nil {
+					return fmt.Errorf("received more than %d '%s' events for '%s' in %s", n, eventType, identity.Name, time.Since(start).Round(time.Millisecond))
+				}
+			}
+
+			// Stop before reading the events so none is added.
+			recorder.Stop()
+
+			matching := recorder.Matching(expectation)
+			evts := make([]*elemental.Event, len(matching))
+			objs := make(elemental.IdentifiablesList, len(matching))
+			for i, e := range matching {
+				if e.Identifiable == nil {
+					return fmt.Errorf("unable to decode '%s' event for '%s'", eventType, identity.Name)
+				}
+				evts[i] = e.Event
+				objs[i] = e.Identifiable
+			}
+
+			if cfg.assertEventsFunc != nil {
+				if err := cfg.assertEventsFunc(evts, objs); err != nil {
+					return err
+				}
+			}
+
+			if cfg.assertEventFunc != nil {
+				for i := range evts {
+					if err := cfg.assertEventFunc(evts[i], objs[i]); err != nil {
+						return err
+					}
+				}
+			}
+
+			return nil
+		}
+	}
+}
+
+// AssertPushes asserts that all the given expectations are met within the
+// positive timeout, each by a distinct push, using a single subscription.
+// The error lists the unmet expectations on timeout. The additional filter
+// and the event asserter options apply to all the expectations.
+func AssertPushes(
+	ctx context.Context,
+	t TestInfo,
+	m manipulate.Manipulator,
+	expectations []PushExpectation,
+	options ...AssertPushOption,
+) func() func() error {
+
+	cfg := newAssertPushConfig()
+	for _, opt := range options {
+		opt(&cfg)
+	}
+
+	expectations = withAdditionalFilter(expectations, cfg.additionalFilterFunc)
+
+	subctx, cancel := context.WithTimeout(ctx, cfg.positiveTimeout)
+
+	pushConfig, subscriberOptions := cfg.subscription(expectations...)
+	recorder, err := newPushRecorder(subctx, t, m, cfg.modelManager, pushConfig, subscriberOptions...)
+
+	Assert(t, fmt.Sprintf("connecting to events channel for [%s] should work", formatExpectations(expectations)), err, convey.ShouldBeNil)
+
+	return func() func() error {
+
+		return func() error {
+			defer cancel()
+			defer recorder.Stop()
+
+			if err := recorder.ExpectAll(cfg.positiveTimeout, expectations...); err != nil {
+				return fmt.Errorf("did not receive all the expected events in time: %s", err)
+			}
+
+			// Stop before reading the events so none is added.
+			recorder.Stop()
+
+			if cfg.assertEventFunc == nil {
+				return nil
+			}
+
+			matched, _ := matchAll(recorder.Events(), expectations)
+			for _, e := range matched {
+				if e.Identifiable == nil {
+					return fmt.Errorf("unable to decode '%s' event for '%s'", e.Type, e.Identity.Name)
+				}
+				if err := cfg.assertEventFunc(e.Event, e.Identifiable); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+	}
+}
+
+// AssertNoPushes asserts that none of the given expectations is met
+// within the negative timeout, using a single subscription.
+func AssertNoPushes(
+	ctx context.Context,
+	t TestInfo,
+	m manipulate.Manipulator,
+	expectations []PushExpectation,
+	options ...AssertPushOption,
+) func() func() error {
+
+	cfg := newAssertPushConfig()
+	for _, opt := range options {
+		opt(&cfg)
+	}
+
+	expectations = withAdditionalFilter(expectations, cfg.additionalFilterFunc)
+
+	subctx, cancel := context.WithTimeout(ctx, cfg.negativeTimeout)
+
+	pushConfig, subscriberOptions := cfg.subscription(expectations...)
+	recorder, err := newPushRecorder(subctx, t, m, cfg.modelManager, pushConfig, subscriberOptions...)
+
+	Assert(t, "connecting to events channel should work", err, convey.ShouldBeNil)
+
+	return func() func() error {
+		return func() error {
+			defer cancel()
+
+			<-subctx.Done()
+			recorder.Stop()
+
+			var received []PushEvent
+			for _, exp := range expectations {
+				received = append(received, recorder.Matching(exp)...)
+			}
+
+			if len(received) > 0 {
+				return fmt.Errorf("received unexpected events: [%s]", formatPushEvents(received))
+			}
+
+			return nil
+		}
+	}
+}
+
+// withAdditionalFilter returns copies of the given expectations
+// also requiring the given filter, if any.
+func withAdditionalFilter(expectations []PushExpectation, filter func(*elemental.Event) bool) []PushExpectation {
+
+	if filter == nil {
+		return expectations
+	}
+
+	out := make([]PushExpectation, len(expectations))
+	for i, exp := range expectations {
+		out[i] = exp
+		if own := exp.Filter; own != nil {
+			out[i].Filter = func(evt *elemental.Event) bool { return own(evt) && filter(evt) }
+		} else {
+			out[i].Filter = filter
+		}
+	}
+
+	return out
+}
+
+// errNoExtraPush is used by AssertPushCount while waiting for
+// pushes that should not come.
+var errNoExtraPush = fmt.Errorf("no extra push")
+
+// countMatching returns the number of events matching the given expectation.
+func countMatching(events []PushEvent, expectation PushExpectation) int {
+
+	count := 0
+	for _, e := range events {
+		if expectation.matches(e.Event) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// AssertSubscriberReconnects asserts that a subscriber connected now gets
+// disconnected and reconnects within the given timeout, like when the
+// gateway restarts. Only the subscriber options apply.
+func AssertSubscriberReconnects(
+	ctx context.Context,
+	t TestInfo,
+	m manipulate.Manipulator,
+	timeout time.Duration,
+	options ...AssertPushOption,
+) func() func() error {
+
+	cfg := newAssertPushConfig()
+	for _, opt := range options {
+		opt(&cfg)
+	}
+
+	subctx, cancel := context.WithTimeout(ctx, timeout)
+
+	pushConfig, subscriberOptions := cfg.subscription()
+	recorder, err := newPushRecorder(subctx, t, m, cfg.modelManager, pushConfig, subscriberOptions...)
+
+	Assert(t, "connecting to events channel should work", err, convey.ShouldBeNil)
+
+	return func() func() error {
+		return func() error {
+			defer cancel()
+			defer recorder.Stop()
+
+			return recorder.ExpectReconnection(timeout)
+		}
+	}
+}
+
 // AssertNoPush asserts a push is not received.
 func AssertNoPush(
 	ctx context.Context,
@@ -153,23 +570,16 @@ func AssertNoPush(
 
 	subctx, cancel := context.WithTimeout(ctx, cfg.negativeTimeout)
 
-	evtch := make(chan *elemental.Event)
-	err := ListenForPushEvent(
+	expectation := PushExpectation{Identity: identity, Type: eventType, Filter: cfg.additionalFilterFunc}
+	pushConfig, subscriberOptions := cfg.subscription(expectation)
+
+	listener, err := ListenForPush(
 		subctx,
+		t,
 		m,
-		func(evt *elemental.Event) bool {
-			if evt.Identity != identity.Name || evt.Type != eventType {
-				return false
-			}
-			if cfg.additionalFilterFunc != nil {
-				if !cfg.additionalFilterFunc(evt) {
-					return false
-				}
-			}
-			return true
-		},
-		evtch,
-		cfg.subscriberOptions...,
+		expectation.matches,
+		pushConfig,
+		subscriberOptions...,
 	)
 
 	Assert(t, "connecting to events channel should work", err, convey.ShouldBeNil)
@@ -177,10 +587,14 @@ func AssertNoPush(
 	return func() func() error {
 		return func() error {
 			defer cancel()
+			defer listener.Close()
 
 			select {
-			case <-evtch:
-				return fmt.Errorf("received an '%s' event for '%s'", eventType, identity.Name)
+			case _, ok := <-listener.Events():
+				if ok {
+					return fmt.Errorf("received an '%s' event for '%s'", eventType, identity.Name)
+				}
+				return nil
 			case <-subctx.Done():
 				return nil
 			}
@@ -188,42 +602,41 @@ func AssertNoPush(
 	}
 }
 
-// ListenForPushEvent listen for a event
+// ListenForPushEvent listen for a event. The subscriber is stopped once
+// the verifier accepts an event or the given context is canceled. The
+// accepted event is then sent to evtCh, if not nil, until the given
+// context is canceled, so the event is not lost if the caller is not
+// receiving yet, and the goroutine does not leak if it never does.
+//
+// Deprecated: use ListenForPush, which returns a handle to close the
+// subscriber and is closed automatically at the end of the test.
 func ListenForPushEvent(ctx context.Context, m manipulate.Manipulator, verifier func(*elemental.Event) bool, evtCh chan *elemental.Event, options ...maniphttp.SubscriberOption) error {
 
-	subscriber := maniphttp.NewSubscriber(m, options...)
-	subscriber.Start(ctx, nil)
-
-	if err := func() error {
-		for {
-			select {
-			case st := <-subscriber.Status():
-				if st == manipulate.SubscriberStatusInitialConnection {
-					return nil
-				}
+	subctx, cancel := context.WithCancel(ctx)
 
-			case err := <-subscriber.Errors():
-				return err
-
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		}
-	}(); err != nil {
-		return fmt.Errorf("unable to connect to event channel: %s", err)
+	subscriber, err := startSubscriber(subctx, m, nil, options...)
+	if err != nil {
+		cancel()
+		return err
 	}
 
 	go func() {
+		defer cancel()
 		for {
 			select {
 			case evt := <-subscriber.Events():
+				metricPushEventsReceived.WithLabelValues(evt.Identity, string(evt.Type)).Inc()
 				if verifier(evt) {
+					cancel()
 					if evtCh != nil {
-						evtCh <- evt
+						select {
+						case evtCh <- evt:
+						case <-ctx.Done():
+						}
 					}
 					return
 				}
-			case <-ctx.Done():
+			case <-subctx.Done():
 				return
 			}
 		}
@@ -231,3 +644,36 @@ func ListenForPushEvent(ctx context.Context, m manipulate.Manipulator, verifier
 
 	return nil
 }
+
+// startSubscriber starts a subscriber with the given push config, which
+// can be nil, and waits for its initial connection. The subscriber stops
+// when the given context is canceled. It fails with the manipulators of
+// the replay mode, as push events are not recorded.
+func startSubscriber(ctx context.Context, m manipulate.Manipulator, pushConfig *elemental.PushConfig, options ...maniphttp.SubscriberOption) (manipulate.Subscriber, error) {
+
+	var subscriber manipulate.Subscriber
+	switch b := m.(type) {
+	case *memoryBackend:
+		subscriber = b.newSubscriber()
+	case replayManipulator:
+		return nil, fmt.Errorf("unable to connect to event channel: push events cannot be replayed, run the tests using them against the api or the %s backend", backendMemory)
+	default:
+		subscriber = maniphttp.NewSubscriber(m, options...)
+	}
+	subscriber.Start(ctx, pushConfig)
+
+	for {
+		select {
+		case st := <-subscriber.Status():
+			if st == manipulate.SubscriberStatusInitialConnection {
+				return subscriber, nil
+			}
+
+		case err := <-subscriber.Errors():
+			return nil, fmt.Errorf("unable to connect to event channel: %s", err)
+
+		case <-ctx.Done():
+			return nil, fmt.Errorf("unable to connect to event channel: %s", ctx.Err())
+		}
+	}
+}
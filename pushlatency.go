@@ -0,0 +1,99 @@
+package apocheck
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goterm"
+)
+
+// A latencyRecorder records the push latencies
+// measured during a test iteration, per identity.
+type latencyRecorder struct {
+	latencies map[string][]time.Duration
+	lock      sync.Mutex
+}
+
+func newLatencyRecorder() *latencyRecorder {
+	return &latencyRecorder{
+		latencies: map[string][]time.Duration{},
+	}
+}
+
+// record records the given latency. It is safe
+// to call on a nil recorder, which does nothing.
+func (r *latencyRecorder) record(identity string, latency time.Duration) {
+
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	r.latencies[identity] = append(r.latencies[identity], latency)
+	r.lock.Unlock()
+}
+
+// snapshot returns the latencies recorded so far.
+func (r *latencyRecorder) snapshot() map[string][]time.Duration {
+
+	if r == nil {
+		return nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	out := make(map[string][]time.Duration, len(r.latencies))
+	for identity, latencies := range r.latencies {
+		out[identity] = append([]time.Duration{}, latencies...)
+	}
+
+	return out
+}
+
+// pushLatencyStats returns the statistics of the push
+// latencies of the given results, per identity.
+func pushLatencyStats(results []testResult) map[string]durationStats {
+
+	all := map[string][]time.Duration{}
+	for _, r := range results {
+		for identity, latencies := range r.pushLatencies {
+			all[identity] = append(all[identity], latencies...)
+		}
+	}
+
+	out := make(map[string]durationStats, len(all))
+	for identity, latencies := range all {
+		out[identity] = computeStats(latencies)
+	}
+
+	return out
+}
+
+// formatPushLatencies returns the given statistics of the push
+// latencies per identity, or an empty string if there are none.
+func formatPushLatencies(stats map[string]durationStats, indent string) string {
+
+	if len(stats) == 0 {
+		return ""
+	}
+
+	identities := make([]string, 0, len(stats))
+	for identity := range stats {
+		identities = append(identities, identity)
+	}
+	sort.Strings(identities)
+
+	b := &strings.Builder{}
+	for _, identity := range identities {
+		fmt.Fprintf(b, "%s%s\n", indent, goterm.Color( // nolint
+			fmt.Sprintf("push latency %s (%d): %s", identity, stats[identity].count, stats[identity]),
+			goterm.BLUE,
+		))
+	}
+
+	return b.String()
+}
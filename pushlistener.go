@@ -0,0 +1,176 @@
+package apocheck
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"go.aporeto.io/elemental"
+	"go.aporeto.io/manipulate"
+	"go.aporeto.io/manipulate/maniphttp"
+)
+
+// pushListenerBufferSize is the number of events a PushListener
+// buffers before dropping the new ones.
+const pushListenerBufferSize = 100
+
+// A subscriberTracker tracks the push subscribers opened during a test
+// iteration so the ones left open can be closed and reported when it ends.
+type subscriberTracker struct {
+	open   map[int]trackedSubscriber
+	nextID int
+	lock   sync.Mutex
+}
+
+type trackedSubscriber struct {
+	description string
+	close       func()
+}
+
+func newSubscriberTracker() *subscriberTracker {
+	return &subscriberTracker{
+		open: map[int]trackedSubscriber{},
+	}
+}
+
+// track tracks a subscriber closed by the given function. The returned
+// function must be called once the subscriber is closed. It is safe to
+// call on a nil tracker, in which case nothing is tracked.
+func (t *subscriberTracker) track(description string, close func()) (untrack func()) {
+
+	if t == nil {
+		return func() {}
+	}
+
+	t.lock.Lock()
+	id := t.nextID
+	t.nextID++
+	t.open[id] = trackedSubscriber{description: description, close: close}
+	t.lock.Unlock()
+
+	return func() {
+		t.lock.Lock()
+		delete(t.open, id)
+		t.lock.Unlock()
+	}
+}
+
+// closeAll closes the subscribers still open and returns their
+// descriptions in the order they were opened.
+func (t *subscriberTracker) closeAll() []string {
+
+	if t == nil {
+		return nil
+	}
+
+	t.lock.Lock()
+	ids := make([]int, 0, len(t.open))
+	for id := range t.open {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	leaked := make([]trackedSubscriber, len(ids))
+	for i, id := range ids {
+		leaked[i] = t.open[id]
+	}
+	t.lock.Unlock()
+
+	descriptions := make([]string, len(leaked))
+	for i, s := range leaked {
+		s.close()
+		descriptions[i] = s.description
+	}
+
+	return descriptions
+}
+
+// A PushListener delivers the push events matching a filter until it is
+// closed. It is closed automatically when the test iteration that opened
+// it ends, and reported as leaked if it was still open.
+type PushListener struct {
+	events  chan *elemental.Event
+	dropped int64
+	cancel  context.CancelFunc
+	done    chan struct{}
+	untrack func()
+	once    sync.Once
+}
+
+// ListenForPush subscribes to the push events of the given manipulator and
+// delivers the ones accepted by the given filter, or all of them if it is
+// nil, on the Events channel of the returned PushListener. If pushConfig
+// is not nil, it is sent to the server to filter the events. Events are
+// dropped if more than 100 are waiting to be read. The listener must be
+// closed with Close once not needed anymore.
+func ListenForPush(
+	ctx context.Context,
+	t TestInfo,
+	m manipulate.Manipulator,
+	filter func(*elemental.Event) bool,
+	pushConfig *elemental.PushConfig,
+	options ...maniphttp.SubscriberOption,
+) (*PushListener, error) {
+
+	subctx, cancel := context.WithCancel(ctx)
+
+	subscriber, err := startSubscriber(subctx, m, pushConfig, options...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	l := &PushListener{
+		events: make(chan *elemental.Event, pushListenerBufferSize),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	l.untrack = t.subscribers.track("push listener", l.Close)
+
+	go func() {
+		defer close(l.done)
+		defer close(l.events)
+
+		for {
+			select {
+			case evt := <-subscriber.Events():
+				metricPushEventsReceived.WithLabelValues(evt.Identity, string(evt.Type)).Inc()
+				if filter != nil && !filter(evt) {
+					continue
+				}
+				select {
+				case l.events <- evt:
+				default:
+					atomic.AddInt64(&l.dropped, 1)
+				}
+			case <-subctx.Done():
+				return
+			}
+		}
+	}()
+
+	return l, nil
+}
+
+// Events returns the channel the matching events are delivered on.
+// It is closed once the listener is closed or its context canceled.
+func (l *PushListener) Events() <-chan *elemental.Event {
+	return l.events
+}
+
+// Dropped returns the number of events dropped because
+// the buffer of the listener was full.
+func (l *PushListener) Dropped() int {
+	return int(atomic.LoadInt64(&l.dropped))
+}
+
+// Close stops the subscriber of the listener. It is safe to call it several times.
+func (l *PushListener) Close() {
+	l.once.Do(func() {
+		l.cancel()
+		<-l.done
+		l.untrack()
+	})
+}
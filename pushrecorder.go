@@ -0,0 +1,503 @@
+package apocheck
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.aporeto.io/elemental"
+	"go.aporeto.io/manipulate"
+	"go.aporeto.io/manipulate/maniphttp"
+)
+
+// A PushExpectation describes an expected push event.
+type PushExpectation struct {
+	Identity elemental.Identity
+	Type     elemental.EventType
+
+	// Filter is an optional additional filter the
+	// event must pass to match the expectation.
+	Filter func(evt *elemental.Event) bool
+}
+
+func (e PushExpectation) matches(evt *elemental.Event) bool {
+
+	if evt.Identity != e.Identity.Name || evt.Type != e.Type {
+		return false
+	}
+
+	return e.Filter == nil || e.Filter(evt)
+}
+
+func (e PushExpectation) String() string {
+	return fmt.Sprintf("%s %s", e.Type, e.Identity.Name)
+}
+
+// A PushEvent is a push event recorded by a PushRecorder.
+type PushEvent struct {
+	Identity elemental.Identity
+	Type     elemental.EventType
+	Time     time.Time
+
+	// Identifiable is the decoded object of the event.
+	// It is nil if the object could not be decoded.
+	Identifiable elemental.Identifiable
+
+	Event *elemental.Event
+}
+
+func (e PushEvent) String() string {
+
+	if e.Identifiable == nil {
+		return fmt.Sprintf("%s %s", e.Type, e.Identity.Name)
+	}
+
+	return fmt.Sprintf("%s %s %s", e.Type, e.Identity.Name, e.Identifiable.Identifier())
+}
+
+// A SubscriberStatusChange is a status change of
+// a subscriber recorded by a PushRecorder.
+type SubscriberStatusChange struct {
+	Status manipulate.SubscriberStatus
+	Time   time.Time
+}
+
+func (c SubscriberStatusChange) String() string {
+	return subscriberStatusName(c.Status)
+}
+
+// A PushRecorder records all the push events received on a single
+// subscription, and the status changes of its subscriber, until the
+// context it was created with is canceled, Stop is called or the test
+// iteration that created it ends.
+type PushRecorder struct {
+	events   []PushEvent
+	statuses []SubscriberStatusChange
+	changed  chan struct{}
+	done     chan struct{}
+	cancel   context.CancelFunc
+	untrack  func()
+	manager  elemental.ModelManager
+	once     sync.Once
+	lock     sync.Mutex
+}
+
+// NewPushRecorder subscribes to the push events of the given manipulator
+// and records them until the given context is canceled or Stop is called.
+// If pushConfig is not nil, it is sent to the server to filter the events.
+// Events are decoded with the model manager set with CommandOptionModelManager.
+func NewPushRecorder(ctx context.Context, t TestInfo, m manipulate.Manipulator, pushConfig *elemental.PushConfig, options ...maniphttp.SubscriberOption) (*PushRecorder, error) {
+	return newPushRecorder(ctx, t, m, mainModelManager, pushConfig, options...)
+}
+
+func newPushRecorder(ctx context.Context, t TestInfo, m manipulate.Manipulator, manager elemental.ModelManager, pushConfig *elemental.PushConfig, options ...maniphttp.SubscriberOption) (*PushRecorder, error) {
+
+	subctx, cancel := context.WithCancel(ctx)
+
+	subscriber, err := startSubscriber(subctx, m, pushConfig, options...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	r := &PushRecorder{
+		statuses: []SubscriberStatusChange{{Status: manipulate.SubscriberStatusInitialConnection, Time: time.Now()}},
+		changed:  make(chan struct{}),
+		done:     make(chan struct{}),
+		cancel:   cancel,
+		manager:  manager,
+	}
+
+	r.untrack = t.subscribers.track("push recorder", r.Stop)
+
+	go func() {
+		defer close(r.done)
+		for {
+			select {
+			case evt := <-subscriber.Events():
+				metricPushEventsReceived.WithLabelValues(evt.Identity, string(evt.Type)).Inc()
+				r.record(evt)
+			case st := <-subscriber.Status():
+				r.recordStatus(st)
+			case <-subctx.Done():
+				return
+			}
+		}
+	}()
+
+	return r, nil
+}
+
+func (r *PushRecorder) record(evt *elemental.Event) {
+
+	e := PushEvent{
+		Type:  evt.Type,
+		Time:  time.Now(),
+		Event: evt,
+	}
+
+	// On error, the identifiable is nil as documented.
+	e.Identity, e.Identifiable, _ = decodeEvent(r.manager, evt)
+
+	r.lock.Lock()
+	r.events = append(r.events, e)
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.lock.Unlock()
+}
+
+func (r *PushRecorder) recordStatus(st manipulate.SubscriberStatus) {
+
+	r.lock.Lock()
+	r.statuses = append(r.statuses, SubscriberStatusChange{Status: st, Time: time.Now()})
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.lock.Unlock()
+}
+
+// Stop stops recording events. It is safe to call it several times.
+func (r *PushRecorder) Stop() {
+	r.once.Do(func() {
+		r.cancel()
+		<-r.done
+		r.untrack()
+	})
+}
+
+// Events returns the events recorded so far.
+func (r *PushRecorder) Events() []PushEvent {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]PushEvent{}, r.events...)
+}
+
+// Statuses returns the status changes of the subscriber recorded so far,
+// starting with its initial connection.
+func (r *PushRecorder) Statuses() []SubscriberStatusChange {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]SubscriberStatusChange{}, r.statuses...)
+}
+
+// ExpectReconnection waits up to timeout for the subscriber to be
+// disconnected and then reconnected. It fails as soon as the subscriber
+// is finally disconnected.
+func (r *PushRecorder) ExpectReconnection(timeout time.Duration) error {
+
+	var final bool
+	err := r.waitLocked(timeout, func() error {
+
+		disconnected := false
+		for _, c := range r.statuses {
+			switch c.Status {
+			case manipulate.SubscriberStatusDisconnection:
+				disconnected = true
+			case manipulate.SubscriberStatusReconnection:
+				if disconnected {
+					return nil
+				}
+			case manipulate.SubscriberStatusFinalDisconnection:
+				final = true
+				return nil
+			}
+		}
+
+		if !disconnected {
+			return fmt.Errorf("subscriber was not disconnected. Statuses: [%s]", formatStatuses(r.statuses))
+		}
+
+		return fmt.Errorf("subscriber did not reconnect. Statuses: [%s]", formatStatuses(r.statuses))
+	})
+	if err != nil {
+		return err
+	}
+
+	if final {
+		return fmt.Errorf("subscriber was finally disconnected. Statuses: [%s]", formatStatuses(r.Statuses()))
+	}
+
+	return nil
+}
+
+// Matching returns the recorded events matching the given expectation.
+func (r *PushRecorder) Matching(expectation PushExpectation) []PushEvent {
+
+	var out []PushEvent
+	for _, e := range r.Events() {
+		if expectation.matches(e.Event) {
+			out = append(out, e)
+		}
+	}
+
+	return out
+}
+
+// wait waits until cond returns nil for the recorded events or the
+// timeout expires, in which case it returns the last error of cond.
+func (r *PushRecorder) wait(timeout time.Duration, cond func(events []PushEvent) error) error {
+	return r.waitLocked(timeout, func() error { return cond(r.events) })
+}
+
+// waitLocked is like wait, but cond is called with the lock
+// held so it can access all the recorded data.
+func (r *PushRecorder) waitLocked(timeout time.Duration, cond func() error) error {
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		r.lock.Lock()
+		err := cond()
+		changed := r.changed
+		r.lock.Unlock()
+
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return err
+		case <-r.done:
+			return fmt.Errorf("%s (recorder stopped)", err)
+		}
+	}
+}
+
+// ExpectSequence waits up to timeout for the recorded events of the expected
+// identities to be exactly the given expectations, in the same order.
+// Events of other identities are ignored.
+func (r *PushRecorder) ExpectSequence(timeout time.Duration, expectations ...PushExpectation) error {
+
+	identities := map[string]struct{}{}
+	for _, e := range expectations {
+		identities[e.Identity.Name] = struct{}{}
+	}
+
+	return r.wait(timeout, func(events []PushEvent) error {
+
+		var got []PushEvent
+		for _, e := range events {
+			if _, ok := identities[e.Identity.Name]; ok {
+				got = append(got, e)
+			}
+		}
+
+		mismatch := len(got) != len(expectations)
+		for i := 0; !mismatch && i < len(got); i++ {
+			mismatch = !expectations[i].matches(got[i].Event)
+		}
+
+		if !mismatch {
+			return nil
+		}
+
+		return fmt.Errorf("expected events [%s], got [%s]", formatExpectations(expectations), formatPushEvents(got))
+	})
+}
+
+// ExpectCount waits up to timeout for exactly n events matching the given
+// expectation. It fails as soon as more than n events are received.
+func (r *PushRecorder) ExpectCount(timeout time.Duration, expectation PushExpectation, n int) error {
+
+	var count int
+	err := r.wait(timeout, func(events []PushEvent) error {
+
+		count = countMatching(events, expectation)
+		if count < n {
+			return fmt.Errorf("expected %d '%s' events, got %d", n, expectation, count)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if count > n {
+		return fmt.Errorf("expected %d '%s' events, got %d", n, expectation, count)
+	}
+
+	return nil
+}
+
+// ExpectAll waits up to timeout for each of the given expectations to be
+// matched by a distinct recorded event, in any order. On timeout, the
+// error lists the unmet expectations.
+func (r *PushRecorder) ExpectAll(timeout time.Duration, expectations ...PushExpectation) error {
+
+	return r.wait(timeout, func(events []PushEvent) error {
+
+		if _, unmet := matchAll(events, expectations); len(unmet) > 0 {
+			return fmt.Errorf("unmet expectations: [%s]", formatExpectations(unmet))
+		}
+
+		return nil
+	})
+}
+
+// matchAll matches each expectation with a distinct recorded event. As an
+// event can match several expectations, the first matching event is not
+// always the right one: an expectation without filter could take the only
+// event a filtered expectation accepts. The expectations are matched with
+// augmenting paths, so the largest possible number of them is met. It
+// returns the matched events, in the order of the expectations, and the
+// unmet expectations.
+func matchAll(events []PushEvent, expectations []PushExpectation) (matched []PushEvent, unmet []PushExpectation) {
+
+	// candidates[i] are the indexes of the events matching expectations[i].
+	candidates := make([][]int, len(expectations))
+	for i, exp := range expectations {
+		for j, e := range events {
+			if exp.matches(e.Event) {
+				candidates[i] = append(candidates[i], j)
+			}
+		}
+	}
+
+	// owner[j] is the index of the expectation event j is assigned to, or -1.
+	owner := make([]int, len(events))
+	for j := range owner {
+		owner[j] = -1
+	}
+
+	// assign tries to assign an event to expectation i, moving the
+	// events already assigned to other expectations if needed. Free
+	// events are preferred, so the events are assigned in order when
+	// nothing needs to be moved.
+	var assign func(i int, visited []bool) bool
+	assign = func(i int, visited []bool) bool {
+		for _, j := range candidates[i] {
+			if owner[j] == -1 {
+				visited[j] = true
+				owner[j] = i
+				return true
+			}
+		}
+		for _, j := range candidates[i] {
+			if visited[j] {
+				continue
+			}
+			visited[j] = true
+			if owner[j] == -1 || assign(owner[j], visited) {
+				owner[j] = i
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := range expectations {
+		assign(i, make([]bool, len(events)))
+	}
+
+	assigned := make([]int, len(expectations))
+	for i := range assigned {
+		assigned[i] = -1
+	}
+	for j, i := range owner {
+		if i != -1 {
+			assigned[i] = j
+		}
+	}
+
+	for i, exp := range expectations {
+		if assigned[i] == -1 {
+			unmet = append(unmet, exp)
+			continue
+		}
+		matched = append(matched, events[assigned[i]])
+	}
+
+	return matched, unmet
+}
+
+// ExpectNoEventAfter checks no event of type then was recorded for an object
+// of the given identity after an event of type first for the same object,
+// like an update after a delete.
+func (r *PushRecorder) ExpectNoEventAfter(identity elemental.Identity, first elemental.EventType, then elemental.EventType) error {
+
+	seen := map[string]struct{}{}
+
+	for _, e := range r.Events() {
+
+		if e.Identity.Name != identity.Name || e.Identifiable == nil {
+			continue
+		}
+
+		id := e.Identifiable.Identifier()
+
+		if _, ok := seen[id]; ok && e.Type == then {
+			return fmt.Errorf("received a '%s' event for %s '%s' after a '%s' event", then, identity.Name, id, first)
+		}
+
+		if e.Type == first {
+			seen[id] = struct{}{}
+		}
+	}
+
+	return nil
+}
+
+// formatExpectations returns the given expectations as text.
+func formatExpectations(expectations []PushExpectation) string {
+
+	out := make([]string, len(expectations))
+	for i, e := range expectations {
+		out[i] = e.String()
+	}
+
+	return strings.Join(out, ", ")
+}
+
+// formatStatuses returns the given status changes as text.
+func formatStatuses(statuses []SubscriberStatusChange) string {
+
+	out := make([]string, len(statuses))
+	for i, c := range statuses {
+		out[i] = c.String()
+	}
+
+	return strings.Join(out, ", ")
+}
+
+// subscriberStatusName returns the name of the given status.
+func subscriberStatusName(st manipulate.SubscriberStatus) string {
+
+	switch st {
+	case manipulate.SubscriberStatusInitialConnection:
+		return "initial connection"
+	case manipulate.SubscriberStatusInitialConnectionFailure:
+		return "initial connection failure"
+	case manipulate.SubscriberStatusReconnection:
+		return "reconnection"
+	case manipulate.SubscriberStatusReconnectionFailure:
+		return "reconnection failure"
+	case manipulate.SubscriberStatusDisconnection:
+		return "disconnection"
+	case manipulate.SubscriberStatusFinalDisconnection:
+		return "final disconnection"
+	case manipulate.SubscriberStatusTokenRenewal:
+		return "token renewal"
+	default:
+		return fmt.Sprintf("unknown status %d", st)
+	}
+}
+
+// formatPushEvents returns the given events as text.
+func formatPushEvents(events []PushEvent) string {
+
+	out := make([]string, len(events))
+	for i, e := range events {
+		out[i] = e.String()
+	}
+
+	return strings.Join(out, ", ")
+}
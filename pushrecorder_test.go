@@ -0,0 +1,142 @@
+package apocheck
+
+import (
+	"reflect"
+	"testing"
+
+	"go.aporeto.io/elemental"
+)
+
+func Test_matchAll(t *testing.T) {
+
+	namespace := elemental.Identity{Name: "namespace"}
+	policy := elemental.Identity{Name: "policy"}
+
+	newEvent := func(identity elemental.Identity, typ elemental.EventType, data string) PushEvent {
+		return PushEvent{
+			Identity: identity,
+			Type:     typ,
+			Event:    &elemental.Event{Identity: identity.Name, Type: typ, JSONData: []byte(data)},
+		}
+	}
+
+	createNS1 := newEvent(namespace, elemental.EventCreate, "ns1")
+	createNS2 := newEvent(namespace, elemental.EventCreate, "ns2")
+	updateNS1 := newEvent(namespace, elemental.EventUpdate, "ns1")
+	createPolicy := newEvent(policy, elemental.EventCreate, "p1")
+
+	events := []PushEvent{createNS1, createPolicy, updateNS1, createNS2}
+
+	isNS1 := func(evt *elemental.Event) bool { return string(evt.JSONData) == "ns1" }
+	isNS2 := func(evt *elemental.Event) bool { return string(evt.JSONData) == "ns2" }
+
+	tests := []struct {
+		name         string
+		events       []PushEvent
+		expectations []PushExpectation
+		wantMatched  []PushEvent
+		wantUnmet    []PushExpectation
+	}{
+		{
+			"no expectation",
+			events,
+			nil,
+			nil,
+			nil,
+		},
+		{
+			"no event",
+			nil,
+			[]PushExpectation{{Identity: namespace, Type: elemental.EventCreate}},
+			nil,
+			[]PushExpectation{{Identity: namespace, Type: elemental.EventCreate}},
+		},
+		{
+			"in the order of the expectations",
+			events,
+			[]PushExpectation{
+				{Identity: namespace, Type: elemental.EventUpdate},
+				{Identity: policy, Type: elemental.EventCreate},
+			},
+			[]PushEvent{updateNS1, createPolicy},
+			nil,
+		},
+		{
+			"distinct events",
+			events,
+			[]PushExpectation{
+				{Identity: namespace, Type: elemental.EventCreate},
+				{Identity: namespace, Type: elemental.EventCreate},
+			},
+			[]PushEvent{createNS1, createNS2},
+			nil,
+		},
+		{
+			"more expectations than events",
+			events,
+			[]PushExpectation{
+				{Identity: namespace, Type: elemental.EventCreate},
+				{Identity: namespace, Type: elemental.EventCreate},
+				{Identity: namespace, Type: elemental.EventCreate},
+			},
+			[]PushEvent{createNS1, createNS2},
+			[]PushExpectation{{Identity: namespace, Type: elemental.EventCreate}},
+		},
+		{
+			"wrong type",
+			events,
+			[]PushExpectation{{Identity: policy, Type: elemental.EventDelete}},
+			nil,
+			[]PushExpectation{{Identity: policy, Type: elemental.EventDelete}},
+		},
+		{
+			"filter",
+			events,
+			[]PushExpectation{{Identity: namespace, Type: elemental.EventCreate, Filter: isNS2}},
+			[]PushEvent{createNS2},
+			nil,
+		},
+		{
+			"overlapping filter",
+			[]PushEvent{createNS1, createNS2},
+			[]PushExpectation{
+				{Identity: namespace, Type: elemental.EventCreate},
+				{Identity: namespace, Type: elemental.EventCreate, Filter: isNS1},
+			},
+			[]PushEvent{createNS2, createNS1},
+			nil,
+		},
+		{
+			"overlapping filters",
+			[]PushEvent{createNS1, createNS2, updateNS1},
+			[]PushExpectation{
+				{Identity: namespace, Type: elemental.EventCreate},
+				{Identity: namespace, Type: elemental.EventCreate, Filter: isNS1},
+				{Identity: namespace, Type: elemental.EventCreate, Filter: isNS1},
+			},
+			[]PushEvent{createNS2, createNS1},
+			[]PushExpectation{{Identity: namespace, Type: elemental.EventCreate}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			matched, unmet := matchAll(tt.events, tt.expectations)
+
+			if !reflect.DeepEqual(matched, tt.wantMatched) {
+				t.Errorf("matchAll() matched = %v, want %v", matched, tt.wantMatched)
+			}
+
+			// Filters cannot be compared, so compare the descriptions.
+			if len(unmet) != len(tt.wantUnmet) {
+				t.Fatalf("matchAll() unmet = %v, want %v", unmet, tt.wantUnmet)
+			}
+			for i := range unmet {
+				if unmet[i].String() != tt.wantUnmet[i].String() {
+					t.Errorf("matchAll() unmet = %v, want %v", unmet, tt.wantUnmet)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package apocheck
+
+import (
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// redactedPlaceholder replaces the redacted secrets.
+	redactedPlaceholder = "<redacted>"
+
+	// minSecretLength is the minimum length of a registered secret.
+	// Shorter secrets are ignored as they would redact unrelated output.
+	minSecretLength = 4
+)
+
+// jwtRegexp matches JSON web tokens.
+var jwtRegexp = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+
+// mainRedactor redacts the secrets from all the output of apocheck.
+var mainRedactor = newRedactor()
+
+// A redactor replaces registered secrets and tokens in the output.
+type redactor struct {
+	secrets  map[string]struct{}
+	replacer *strings.Replacer
+	lock     sync.RWMutex
+}
+
+func newRedactor() *redactor {
+	return &redactor{
+		secrets:  map[string]struct{}{},
+		replacer: strings.NewReplacer(),
+	}
+}
+
+// register registers the given secrets.
+func (r *redactor) register(secrets ...string) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	changed := false
+	for _, s := range secrets {
+		if len(s) < minSecretLength {
+			continue
+		}
+		if _, ok := r.secrets[s]; ok {
+			continue
+		}
+		r.secrets[s] = struct{}{}
+		changed = true
+	}
+
+	if !changed {
+		return
+	}
+
+	// Longest secrets first, so a secret containing
+	// another one is entirely redacted.
+	secretsList := make([]string, 0, len(r.secrets))
+	for s := range r.secrets {
+		secretsList = append(secretsList, s)
+	}
+	sort.Slice(secretsList, func(i int, j int) bool { return len(secretsList[i]) > len(secretsList[j]) })
+
+	pairs := make([]string, 0, len(secretsList)*2)
+	for _, s := range secretsList {
+		pairs = append(pairs, s, redactedPlaceholder)
+	}
+
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// redact returns the given string without secrets.
+func (r *redactor) redact(s string) string {
+
+	r.lock.RLock()
+	replacer := r.replacer
+	r.lock.RUnlock()
+
+	return jwtRegexp.ReplaceAllString(replacer.Replace(s), redactedPlaceholder)
+}
+
+// redactedWrite writes p to w after redacting the secrets.
+// It returns len(p) on success to respect the io.Writer contract.
+func redactedWrite(w io.Writer, p []byte) (int, error) {
+
+	if _, err := w.Write([]byte(mainRedactor.redact(string(p)))); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// RegisterSecrets registers secrets that will be redacted from
+// all the output of apocheck, like logs, reports and HTTP captures.
+// Secrets shorter than 4 characters are ignored.
+func RegisterSecrets(secrets ...string) {
+	mainRedactor.register(secrets...)
+}
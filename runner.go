@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,14 +16,17 @@ import (
 	"go.aporeto.io/elemental"
 	"go.aporeto.io/manipulate"
 	"go.aporeto.io/manipulate/maniphttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type testRun struct {
-	buildID  string
-	ctx      context.Context
-	test     Test
-	testInfo TestInfo
-	verbose  bool
+	buildID       string
+	ctx           context.Context
+	reproCommands int
+	test          Test
+	testInfo      TestInfo
+	verbose       bool
 }
 
 type testResult struct {
@@ -32,123 +36,268 @@ type testResult struct {
 	test      Test
 	iteration int
 	stack     []byte
+	steps     []*StepInfo
+	exchanges []*httpExchange
+
+	// leakedSubscribers are the push subscribers
+	// left open when the iteration ended.
+	leakedSubscribers []string
+
+	// pushLatencies are the push latencies
+	// measured during the iteration, per identity.
+	pushLatencies map[string][]time.Duration
 }
 
 type testRunner struct {
 	concurrent        int
 	encoding          elemental.EncodingType
 	buildID           string
+	captureHTTP       bool
+	hasSystemCert     bool
+	load              loadProfile
+	memory            *memoryBackend
+	recordDir         string
+	replayDir         string
+	namespace         string
 	privateAPI        string
 	privateTLSConfig  *tls.Config
 	publicAPI         string
 	publicManipulator manipulate.Manipulator
 	publicTLSConfig   *tls.Config
+	reproCommands     int
 	resultsChan       chan testRun
 	rootManipulator   manipulate.Manipulator
 	setupErrs         chan error
 	skipTeardown      bool
+	soak              time.Duration
+	soakInterval      time.Duration
 	status            map[string]testRun
 	stopOnFailure     bool
 	stress            int
 	suite             *suiteInfo
 	teardowns         chan TearDownFunction
 	timeout           time.Duration
+	token             string
+	tokenManager      manipulate.TokenManager
+	traced            bool
+	transports        []transportWrapper
 	verbose           bool
 }
 
-func newTestRunner(
-	ctx context.Context,
-	buildID string,
-	privateAPI string,
-	privateCAPool *x509.CertPool,
-	systemCert *tls.Certificate,
-	publicAPI string,
-	publicCAPool *x509.CertPool,
-	token string,
-	namespace string,
-	suite *suiteInfo,
-	timeout time.Duration,
-	concurrent int,
-	stress int,
-	verbose bool,
-	skipTeardown bool,
-	stopOnFailure bool,
-	encoding elemental.EncodingType,
-) *testRunner {
-
-	publicTLSConfig := &tls.Config{
-		RootCAs:            publicCAPool,
-		InsecureSkipVerify: true, // nolint
+// A testRunnerConfig holds the parameters of a testRunner.
+type testRunnerConfig struct {
+	buildID string
+
+	privateAPI        string
+	privateCAPool     *x509.CertPool
+	insecurePrivate   bool
+	privateServerName string
+	systemCert        *tls.Certificate
+
+	publicAPI        string
+	publicCAPool     *x509.CertPool
+	insecurePublic   bool
+	publicServerName string
+	token            string
+	tokenManager     manipulate.TokenManager
+	namespace        string
+
+	timeout       time.Duration
+	concurrent    int
+	stress        int
+	soak          time.Duration
+	soakInterval  time.Duration
+	load          loadProfile
+	verbose       bool
+	skipTeardown  bool
+	stopOnFailure bool
+	encoding      elemental.EncodingType
+	backend       string
+	transports    []transportWrapper
+	traced        bool
+	captureHTTP   bool
+	reproCommands int
+	recordDir     string
+	replayDir     string
+}
+
+func newTestRunner(ctx context.Context, suite *suiteInfo, cfg testRunnerConfig) (*testRunner, error) {
+
+	publicTLSConfig := newTLSConfig(cfg.publicAPI, cfg.publicCAPool, nil, cfg.publicServerName, cfg.insecurePublic, "public")
+
+	var certificates []tls.Certificate
+	if cfg.systemCert != nil {
+		certificates = []tls.Certificate{*cfg.systemCert}
+	}
+	privateTLSConfig := newTLSConfig(cfg.privateAPI, cfg.privateCAPool, certificates, cfg.privateServerName, cfg.insecurePrivate, "private")
+
+	r := &testRunner{
+		captureHTTP:      cfg.captureHTTP,
+		concurrent:       cfg.concurrent,
+		hasSystemCert:    cfg.systemCert != nil,
+		namespace:        cfg.namespace,
+		privateAPI:       cfg.privateAPI,
+		privateTLSConfig: privateTLSConfig,
+		publicAPI:        cfg.publicAPI,
+		publicTLSConfig:  publicTLSConfig,
+		recordDir:        cfg.recordDir,
+		replayDir:        cfg.replayDir,
+		reproCommands:    cfg.reproCommands,
+		resultsChan:      make(chan testRun, cfg.concurrent*cfg.stress),
+		setupErrs:        make(chan error),
+		skipTeardown:     cfg.skipTeardown,
+		soak:             cfg.soak,
+		soakInterval:     cfg.soakInterval,
+		load:             cfg.load,
+		status:           map[string]testRun{},
+		stopOnFailure:    cfg.stopOnFailure,
+		stress:           cfg.stress,
+		suite:            suite,
+		timeout:          cfg.timeout,
+		token:            cfg.token,
+		tokenManager:     cfg.tokenManager,
+		traced:           cfg.traced,
+		transports:       cfg.transports,
+		verbose:          cfg.verbose,
+		encoding:         cfg.encoding,
+		buildID:          cfg.buildID,
 	}
 
-	privateTLSConfig := &tls.Config{}
-	if systemCert != nil && privateCAPool != nil {
-		privateTLSConfig = &tls.Config{
-			RootCAs:            privateCAPool,
-			Certificates:       []tls.Certificate{*systemCert},
-			InsecureSkipVerify: true, // nolint
+	var err error
+	if cfg.backend == backendMemory {
+		if r.memory, err = newMemoryBackend(mainModelManager); err != nil {
+			return nil, err
 		}
 	}
 
-	// Public Manipulator
-	var publicManipulator manipulate.Manipulator
-	if token != "" && publicAPI != "" {
-		publicManipulator, _ = maniphttp.New(
+	r.publicManipulator, r.rootManipulator, err = r.newManipulators(ctx, cfg.transports)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// newManipulators returns the public and root manipulators using the
+// given transport wrappers. A manipulator is nil if the configuration
+// does not allow to create it. With the memory backend, both are the
+// in-memory manipulator.
+func (r *testRunner) newManipulators(ctx context.Context, transports []transportWrapper) (publicManipulator manipulate.Manipulator, rootManipulator manipulate.Manipulator, err error) {
+
+	if r.memory != nil {
+		return r.memory, r.memory, nil
+	}
+
+	// Public Manipulator. When replaying, the manipulators
+	// are created without credentials as they are not used.
+	if (r.token != "" || r.tokenManager != nil || r.replayDir != "") && r.publicAPI != "" {
+
+		tokenOption := maniphttp.OptionToken(r.token)
+		if r.tokenManager != nil {
+			tokenOption = maniphttp.OptionTokenManager(r.tokenManager)
+		}
+
+		publicManipulator, err = maniphttp.New(
 			ctx,
-			publicAPI,
-			maniphttp.OptionToken(token),
-			maniphttp.OptionNamespace(namespace),
-			maniphttp.OptionEncoding(encoding),
-			maniphttp.OptionTLSConfig(publicTLSConfig),
+			r.publicAPI,
+			append(
+				httpOptions(r.publicTLSConfig, transports),
+				tokenOption,
+				maniphttp.OptionNamespace(r.namespace),
+				maniphttp.OptionEncoding(r.encoding),
+			)...,
 		)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to create public manipulator for '%s': %s", r.publicAPI, err)
+		}
 	}
 
 	// private manipulator
-	var rootManipulator manipulate.Manipulator
-	if systemCert != nil && privateAPI != "" {
-		rootManipulator, _ = maniphttp.New(
+	if (r.hasSystemCert || r.replayDir != "") && r.privateAPI != "" {
+		rootManipulator, err = maniphttp.New(
 			ctx,
-			privateAPI,
-			maniphttp.OptionNamespace(namespace),
-			maniphttp.OptionTLSConfig(privateTLSConfig),
-			maniphttp.OptionEncoding(encoding),
+			r.privateAPI,
+			append(
+				httpOptions(r.privateTLSConfig, transports),
+				maniphttp.OptionNamespace(r.namespace),
+				maniphttp.OptionEncoding(r.encoding),
+			)...,
 		)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to create root manipulator for '%s': %s", r.privateAPI, err)
+		}
 	}
 
-	return &testRunner{
-		concurrent:        concurrent,
-		privateAPI:        privateAPI,
-		privateTLSConfig:  privateTLSConfig,
-		publicAPI:         publicAPI,
-		publicManipulator: publicManipulator,
-		publicTLSConfig:   publicTLSConfig,
-		resultsChan:       make(chan testRun, concurrent*stress),
-		rootManipulator:   rootManipulator,
-		setupErrs:         make(chan error),
-		skipTeardown:      skipTeardown,
-		status:            map[string]testRun{},
-		stopOnFailure:     stopOnFailure,
-		stress:            stress,
-		suite:             suite,
-		timeout:           timeout,
-		verbose:           verbose,
-		encoding:          encoding,
-		buildID:           buildID,
+	if r.replayDir != "" {
+		if publicManipulator != nil {
+			publicManipulator = replayManipulator{publicManipulator}
+		}
+		if rootManipulator != nil {
+			rootManipulator = replayManipulator{rootManipulator}
+		}
+	}
+
+	return publicManipulator, rootManipulator, nil
+}
+
+// capabilities returns the capabilities available to the tests.
+func (r *testRunner) capabilities() map[Capability]bool {
+	return map[Capability]bool{
+		PublicAPI:  r.publicManipulator != nil,
+		PrivateAPI: r.rootManipulator != nil,
 	}
 }
 
+// executeIteration runs the iterations of the given test and sends their
+// results to the given channel. It runs r.stress iterations, or keeps
+// launching new ones until r.soak elapses if set. Launches are paced
+// by the load profile r.load if any. The results channel
+// is closed once all launched iterations are done.
 func (r *testRunner) executeIteration(ctx context.Context, currTest testRun, rootManipulator manipulate.Manipulator, publicManipulator manipulate.Manipulator, results chan testResult) {
 
 	sem := make(chan struct{}, r.concurrent)
 
-	for i := 0; i < r.stress; i++ {
+	var wg sync.WaitGroup
+	defer func() {
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+	}()
+
+	launchCtx := ctx
+	if r.soak > 0 {
+		var cancel context.CancelFunc
+		launchCtx, cancel = context.WithTimeout(ctx, r.soak)
+		defer cancel()
+	}
+
+	var pace *pacer
+	if r.load != nil {
+		pace = newPacer(r.load)
+	}
+
+	for i := 0; r.soak > 0 || i < r.stress; i++ {
+
+		if pace != nil {
+			if err := pace.wait(launchCtx); err != nil {
+				return
+			}
+		}
 
 		select {
 		case sem <- struct{}{}:
-		case <-ctx.Done():
+		case <-launchCtx.Done():
 			return
 		}
 
+		if launchCtx.Err() != nil {
+			<-sem
+			return
+		}
+
+		wg.Add(1)
+
 		go func(t testRun, iteration int) {
 			var data interface{}
 			var td TearDownFunction
@@ -156,7 +305,29 @@ func (r *testRunner) executeIteration(ctx context.Context, currTest testRun, roo
 
 			buf := &bytes.Buffer{}
 
-			defer func() { <-sem }()
+			defer func() { <-sem; wg.Done() }()
+
+			recordIterationStart(t.test)
+
+			ictx, span := tracer.Start(
+				ctx,
+				fmt.Sprintf("iteration %d", iteration+1),
+				trace.WithAttributes(append(testAttributes(t.test), attribute.Int("apocheck.iteration", iteration+1))...),
+			)
+
+			// The per-iteration manipulators run until this context is
+			// canceled, so it must not outlive the iteration.
+			ictx, cancel := context.WithCancel(ictx)
+			defer cancel()
+
+			steps := newStepRecorder(ictx, time.Now())
+			subscribers := newSubscriberTracker()
+			latencies := newLatencyRecorder()
+
+			var capture *httpRecorder
+			var tape *cassette
+			transports := r.transports
+			pm, rm := publicManipulator, rootManipulator
 
 			ti := testResult{
 				test:      t.test,
@@ -166,7 +337,27 @@ func (r *testRunner) executeIteration(ctx context.Context, currTest testRun, roo
 
 			defer func() {
 
-				defer func() { results <- ti }()
+				defer func() {
+					if tape != nil && r.recordDir != "" {
+						if err := tape.save(r.recordDir, t.test.id, iteration); err != nil && ti.err == nil {
+							ti.err = err
+						}
+					}
+					if tape != nil && r.replayDir != "" && ti.err == nil {
+						if remaining := tape.remaining(); len(remaining) > 0 {
+							ti.err = fmt.Errorf("replay: %d recorded requests were not made: %s", len(remaining), strings.Join(remaining, ", "))
+						}
+					}
+					ti.leakedSubscribers = subscribers.closeAll()
+					ti.pushLatencies = latencies.snapshot()
+					ti.steps = steps.snapshot()
+					if capture != nil {
+						ti.exchanges = capture.snapshot()
+					}
+					recordIterationEnd(t.test, ti.duration, ti.err)
+					endSpan(span, ti.err)
+					results <- ti
+				}()
 
 				// recover remote code.
 				r := recover()
@@ -174,8 +365,11 @@ func (r *testRunner) executeIteration(ctx context.Context, currTest testRun, roo
 					return
 				}
 
-				err, ok := r.(assertionError)
-				if ok {
+				switch err := r.(type) {
+				case assertionError:
+					ti.err = err
+					return
+				case StepError:
 					ti.err = err
 					return
 				}
@@ -184,25 +378,68 @@ func (r *testRunner) executeIteration(ctx context.Context, currTest testRun, roo
 				ti.stack = debug.Stack()
 			}()
 
+			// When recording or replaying, the test ID is the
+			// recorded one as it is part of the created objects.
+			testID := uuid.Must(uuid.NewV4()).String()
+			switch {
+			case r.replayDir != "":
+				if tape, err = loadCassette(r.replayDir, t.test.id, iteration); err != nil {
+					ti.err = err
+					return
+				}
+				testID = tape.TestID
+			case r.recordDir != "":
+				tape = &cassette{TestID: testID}
+			}
+
+			// When tracing, capturing, recording or replaying HTTP
+			// requests, each iteration uses its own manipulators so
+			// requests can be attached to the iteration.
+			if r.traced || r.captureHTTP || tape != nil {
+				transports = append([]transportWrapper{}, r.transports...)
+				switch {
+				case r.replayDir != "":
+					transports = append([]transportWrapper{tape.replay}, transports...)
+				case r.recordDir != "":
+					transports = append([]transportWrapper{tape.record}, transports...)
+				}
+				if r.traced {
+					transports = append(transports, traceTransport(steps.context))
+				}
+				if r.captureHTTP {
+					capture = newHTTPRecorder()
+					transports = append(transports, capture.transport)
+				}
+				if pm, rm, err = r.newManipulators(ictx, transports); err != nil {
+					ti.err = err
+					return
+				}
+			}
+
 			subTestInfo := TestInfo{
 				data:              data,
 				iteration:         iteration,
+				memory:            r.memory,
 				privateAPI:        r.privateAPI,
 				privateTLSConfig:  r.privateTLSConfig,
 				publicAPI:         r.publicAPI,
-				publicManipulator: publicManipulator,
+				publicManipulator: pm,
 				publicTLSConfig:   r.publicTLSConfig,
-				rootManipulator:   rootManipulator,
-				testID:            uuid.Must(uuid.NewV4()).String(),
-				timeOfLastStep:    t.testInfo.timeOfLastStep,
+				pushLatencies:     latencies,
+				replaying:         r.replayDir != "",
+				rootManipulator:   rm,
+				steps:             steps,
+				subscribers:       subscribers,
+				testID:            testID,
 				timeout:           r.timeout,
+				transports:        transports,
 				writer:            buf,
 				encoding:          r.encoding,
 				suite:             r.suite,
 			}
 
 			if t.test.Setup != nil {
-				data, td, err = t.test.Setup(t.ctx, subTestInfo)
+				data, td, err = t.test.Setup(ictx, subTestInfo)
 				if err != nil {
 					printSetupError(t.test.id, t.test.SuiteName, t.test.Name, nil, err)
 					ti.err = err
@@ -220,8 +457,9 @@ func (r *testRunner) executeIteration(ctx context.Context, currTest testRun, roo
 			}
 
 			start := time.Now()
-			ti.err = t.test.Function(ctx, subTestInfo)
-			ti.duration = time.Since(start)
+			defer func() { ti.duration = time.Since(start) }()
+
+			ti.err = t.test.Function(ictx, subTestInfo)
 
 		}(currTest, i)
 	}
@@ -236,9 +474,16 @@ func (r *testRunner) execute(ctx context.Context, rootManipulator manipulate.Man
 	var wg sync.WaitGroup
 	var err error
 
+	available := r.capabilities()
+
 L:
 	for _, test := range r.suite.tests.sorted() {
 
+		if missing := test.missingCapabilities(available); len(missing) > 0 {
+			printSkipped(test, missing)
+			continue
+		}
+
 		wg.Add(1)
 
 		select {
@@ -259,23 +504,52 @@ L:
 
 			defer func() { wg.Done(); <-sem }()
 
+			tctx, span := tracer.Start(run.ctx, run.test.Name, trace.WithAttributes(testAttributes(run.test)...))
+
+			var testErr error
+			defer func() { endSpan(span, testErr) }()
+
 			resultsCh := make(chan testResult)
 
-			go r.executeIteration(ctx, run, rootManipulator, publicManipulator, resultsCh)
+			go r.executeIteration(tctx, run, rootManipulator, publicManipulator, resultsCh)
 
 			var results []testResult
 
+			// Soak runs can last for hours: the results are
+			// aggregated, and only the last failed ones are
+			// kept to print their logs.
+			var soak *soakSummary
+			var progress <-chan time.Time
+			if r.soak > 0 {
+				soak = newSoakSummary()
+				ticker := time.NewTicker(r.soakInterval)
+				defer ticker.Stop()
+				progress = ticker.C
+			}
+
 		L2:
 			for {
 				select {
-				case res := <-resultsCh:
-					results = append(results, res)
+				case res, ok := <-resultsCh:
+					if !ok {
+						if len(results) > 0 || soak != nil && soak.iterations > 0 {
+							appendResults(run, results, soak, r.verbose)
+						}
+						break L2
+					}
+
+					if soak != nil {
+						soak.add(res)
+					} else {
+						results = append(results, res)
+					}
 
 					if res.err != nil {
 						err = res.err
+						testErr = res.err
 
 						if r.stopOnFailure {
-							appendResults(run, results, r.verbose)
+							appendResults(run, results, soak, r.verbose)
 							fmt.Println(hdr.String())
 							fmt.Println(buf.String())
 							close(stop)
@@ -284,10 +558,9 @@ L:
 						}
 					}
 
-					if len(results) == r.stress {
-						appendResults(run, results, r.verbose)
-						break L2
-					}
+				case <-progress:
+					printSoakProgress(run, soak, r.soakInterval)
+
 				case <-ctx.Done():
 					break L2
 				}
@@ -300,19 +573,22 @@ L:
 				fmt.Println(buf.String())
 			}
 		}(testRun{
-			ctx:     ctx,
-			buildID: r.buildID,
-			test:    test,
-			verbose: r.verbose,
+			ctx:           ctx,
+			buildID:       r.buildID,
+			reproCommands: r.reproCommands,
+			test:          test,
+			verbose:       r.verbose,
 			testInfo: TestInfo{
+				memory:            r.memory,
 				privateAPI:        r.privateAPI,
 				privateTLSConfig:  r.privateTLSConfig,
 				publicAPI:         r.publicAPI,
 				publicManipulator: publicManipulator,
 				publicTLSConfig:   r.publicTLSConfig,
 				rootManipulator:   rootManipulator,
-				timeOfLastStep:    time.Now(),
+				steps:             newStepRecorder(ctx, time.Now()),
 				timeout:           r.timeout,
+				transports:        r.transports,
 				encoding:          r.encoding,
 				suite:             r.suite,
 			},
@@ -332,7 +608,10 @@ L:
 	return err
 }
 
-func (r *testRunner) Run(ctx context.Context, suite *suiteInfo) error {
+func (r *testRunner) Run(ctx context.Context, suite *suiteInfo) (err error) {
+
+	ctx, span := tracer.Start(ctx, suite.Name, trace.WithAttributes(attribute.String("apocheck.suite.name", suite.Name)))
+	defer func() { endSpan(span, err) }()
 
 	if suite.Setup != nil {
 
@@ -0,0 +1,107 @@
+package apocheck
+
+import (
+	"time"
+)
+
+// soakKeptFailures is the number of failed iterations whose
+// results are kept during a soak run, to print their logs.
+const soakKeptFailures = 10
+
+// A soakSummary aggregates the results of the iterations of a soak run
+// as they come, so the memory it uses does not grow with their number.
+// It keeps the results of the last failed iterations only, and the
+// durations of the iterations done since the last progress line, to
+// report the current latency.
+type soakSummary struct {
+	iterations       int
+	failures         int
+	kept             []testResult
+	next             int
+	durations        *durationHistogram
+	window           []time.Duration
+	pushLatencies    map[string]*durationHistogram
+	leaks            int
+	leakedIterations int
+}
+
+func newSoakSummary() *soakSummary {
+	return &soakSummary{
+		durations:     newDurationHistogram(),
+		pushLatencies: map[string]*durationHistogram{},
+	}
+}
+
+// add adds the given result.
+func (s *soakSummary) add(r testResult) {
+
+	s.iterations++
+	if r.err != nil {
+		s.failures++
+		s.keep(r)
+	}
+
+	s.durations.add(r.duration)
+	s.window = append(s.window, r.duration)
+
+	for identity, latencies := range r.pushLatencies {
+		h, ok := s.pushLatencies[identity]
+		if !ok {
+			h = newDurationHistogram()
+			s.pushLatencies[identity] = h
+		}
+		for _, l := range latencies {
+			h.add(l)
+		}
+	}
+
+	if len(r.leakedSubscribers) > 0 {
+		s.leaks += len(r.leakedSubscribers)
+		s.leakedIterations++
+	}
+}
+
+// keep keeps the given result, replacing the
+// oldest kept one once soakKeptFailures are kept.
+func (s *soakSummary) keep(r testResult) {
+
+	if len(s.kept) < soakKeptFailures {
+		s.kept = append(s.kept, r)
+		return
+	}
+
+	s.kept[s.next] = r
+	s.next = (s.next + 1) % soakKeptFailures
+}
+
+// failedResults returns the results of the last
+// failed iterations, from the oldest to the newest.
+func (s *soakSummary) failedResults() []testResult {
+
+	out := make([]testResult, 0, len(s.kept))
+	out = append(out, s.kept[s.next:]...)
+	out = append(out, s.kept[:s.next]...)
+
+	return out
+}
+
+// flushWindow returns the statistics of the durations
+// added since the last call, and forgets them.
+func (s *soakSummary) flushWindow() durationStats {
+
+	stats := computeStats(s.window)
+	s.window = s.window[:0]
+
+	return stats
+}
+
+// pushLatencyStats returns the statistics of the push latencies per identity.
+func (s *soakSummary) pushLatencyStats() map[string]durationStats {
+
+	out := make(map[string]durationStats, len(s.pushLatencies))
+	for identity, h := range s.pushLatencies {
+		out[identity] = h.stats()
+	}
+
+	return out
+}
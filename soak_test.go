@@ -0,0 +1,95 @@
+package apocheck
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_soakSummary(t *testing.T) {
+
+	s := newSoakSummary()
+
+	s.add(testResult{duration: time.Second})
+	s.add(testResult{
+		duration:          3 * time.Second,
+		err:               errors.New("boom"),
+		leakedSubscribers: []string{"push listener", "push recorder"},
+		pushLatencies:     map[string][]time.Duration{"namespace": {time.Millisecond, 3 * time.Millisecond}},
+	})
+
+	if s.iterations != 2 {
+		t.Errorf("iterations = %d, want 2", s.iterations)
+	}
+	if s.failures != 1 {
+		t.Errorf("failures = %d, want 1", s.failures)
+	}
+	if s.leaks != 2 || s.leakedIterations != 1 {
+		t.Errorf("leaks = %d by %d iterations, want 2 by 1", s.leaks, s.leakedIterations)
+	}
+
+	if got := s.durations.stats(); got.count != 2 || got.min != time.Second || got.max != 3*time.Second {
+		t.Errorf("durations.stats() = %+v, want 2 durations from 1s to 3s", got)
+	}
+
+	latencies := s.pushLatencyStats()
+	if got := latencies["namespace"]; got.count != 2 || got.max != 3*time.Millisecond {
+		t.Errorf("pushLatencyStats()[namespace] = %+v, want 2 latencies up to 3ms", got)
+	}
+
+	if got := s.flushWindow(); got.count != 2 || got.p99 != 3*time.Second {
+		t.Errorf("flushWindow() = %+v, want 2 durations with p99 3s", got)
+	}
+
+	s.add(testResult{duration: 2 * time.Second})
+
+	if got := s.flushWindow(); got.count != 1 || got.p99 != 2*time.Second {
+		t.Errorf("flushWindow() = %+v, want only the duration added since the last flush", got)
+	}
+
+	if got := s.flushWindow(); got.count != 0 {
+		t.Errorf("flushWindow() = %+v, want empty stats", got)
+	}
+
+	if s.iterations != 3 {
+		t.Errorf("iterations = %d, want 3", s.iterations)
+	}
+}
+
+func Test_soakSummaryFailedResults(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		iterations int
+		failEvery  int
+		want       []int
+	}{
+		{"no failure", 100, 0, []int{}},
+		{"few failures", 10, 2, []int{1, 3, 5, 7, 9}},
+		{"many failures", 100, 1, []int{90, 91, 92, 93, 94, 95, 96, 97, 98, 99}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			s := newSoakSummary()
+			for i := 0; i < tt.iterations; i++ {
+				r := testResult{iteration: i, duration: time.Second}
+				if tt.failEvery > 0 && (i+1)%tt.failEvery == 0 {
+					r.err = errors.New("boom")
+				}
+				s.add(r)
+			}
+
+			got := []int{}
+			for _, r := range s.failedResults() {
+				got = append(got, r.iteration)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("failedResults() iterations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
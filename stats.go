@@ -0,0 +1,307 @@
+package apocheck
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	histogramBuckets = 10
+	histogramWidth   = 40
+
+	// durationHistogramGrowth is the ratio between the bounds of the
+	// buckets of a durationHistogram. The percentiles it gives are
+	// within half a percent of the actual ones.
+	durationHistogramGrowth = 1.01
+)
+
+// durationStats holds statistics about a set of durations.
+type durationStats struct {
+	count  int
+	min    time.Duration
+	max    time.Duration
+	mean   time.Duration
+	p50    time.Duration
+	p90    time.Duration
+	p99    time.Duration
+	stddev time.Duration
+}
+
+func computeStats(durations []time.Duration) durationStats {
+
+	if len(durations) == 0 {
+		return durationStats{}
+	}
+
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i int, j int) bool { return sorted[i] < sorted[j] })
+
+	var total float64
+	for _, d := range sorted {
+		total += float64(d)
+	}
+	mean := total / float64(len(sorted))
+
+	var variance float64
+	for _, d := range sorted {
+		variance += (float64(d) - mean) * (float64(d) - mean)
+	}
+	variance /= float64(len(sorted))
+
+	return durationStats{
+		count:  len(sorted),
+		min:    sorted[0],
+		max:    sorted[len(sorted)-1],
+		mean:   time.Duration(mean),
+		p50:    percentile(sorted, 50),
+		p90:    percentile(sorted, 90),
+		p99:    percentile(sorted, 99),
+		stddev: time.Duration(math.Sqrt(variance)),
+	}
+}
+
+// percentile returns the nearest rank percentile p of the given sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+func (s durationStats) String() string {
+	return fmt.Sprintf("min: %s, p50: %s, p90: %s, p99: %s, max: %s, stddev: %s",
+		s.min.Round(time.Millisecond),
+		s.p50.Round(time.Millisecond),
+		s.p90.Round(time.Millisecond),
+		s.p99.Round(time.Millisecond),
+		s.max.Round(time.Millisecond),
+		s.stddev.Round(time.Millisecond),
+	)
+}
+
+// formatHistogram returns a compact text histogram of the given durations.
+func formatHistogram(durations []time.Duration, indent string) string {
+
+	if len(durations) == 0 {
+		return ""
+	}
+
+	stats := computeStats(durations)
+	width := histogramWidthFor(stats)
+
+	counts := make([]int, histogramBuckets)
+	for _, d := range durations {
+		counts[histogramBucket(d, stats.min, width)]++
+	}
+
+	return formatHistogramCounts(counts, stats.min, width, indent)
+}
+
+// histogramWidthFor returns the width of the buckets
+// of the histogram of durations with the given stats.
+func histogramWidthFor(stats durationStats) time.Duration {
+
+	width := (stats.max - stats.min) / histogramBuckets
+	if width <= 0 {
+		width = 1
+	}
+
+	return width
+}
+
+// histogramBucket returns the index of the histogram bucket of the given duration.
+func histogramBucket(d time.Duration, min time.Duration, width time.Duration) int {
+
+	i := int((d - min) / width)
+	if i < 0 {
+		i = 0
+	}
+	if i >= histogramBuckets {
+		i = histogramBuckets - 1
+	}
+
+	return i
+}
+
+// formatHistogramCounts returns a compact text histogram of the given bucket
+// counts, the first bucket starting at min and each being width wide.
+func formatHistogramCounts(counts []int, min time.Duration, width time.Duration, indent string) string {
+
+	var highest int
+	for _, c := range counts {
+		if c > highest {
+			highest = c
+		}
+	}
+
+	b := &strings.Builder{}
+	for i, c := range counts {
+		lower := min + time.Duration(i)*width
+		fmt.Fprintf(b, "%s%10s %-*s %d\n", // nolint
+			indent,
+			lower.Round(time.Millisecond),
+			histogramWidth,
+			strings.Repeat("#", c*histogramWidth/highest),
+			c,
+		)
+	}
+
+	return b.String()
+}
+
+func resultDurations(results []testResult) []time.Duration {
+
+	out := make([]time.Duration, len(results))
+	for i, r := range results {
+		out[i] = r.duration
+	}
+
+	return out
+}
+
+// A durationHistogram summarizes durations in logarithmic buckets. Its size
+// only depends on the range of the durations, not on their number, so it
+// can summarize the iterations of runs lasting for hours.
+type durationHistogram struct {
+	counts map[int]int
+	count  int
+	min    time.Duration
+	max    time.Duration
+	mean   float64
+	m2     float64
+}
+
+func newDurationHistogram() *durationHistogram {
+	return &durationHistogram{
+		counts: map[int]int{},
+	}
+}
+
+// add adds the given duration.
+func (h *durationHistogram) add(d time.Duration) {
+
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if h.count == 0 || d > h.max {
+		h.max = d
+	}
+
+	// Welford's algorithm, to compute the
+	// standard deviation without the durations.
+	h.count++
+	delta := float64(d) - h.mean
+	h.mean += delta / float64(h.count)
+	h.m2 += delta * (float64(d) - h.mean)
+
+	h.counts[durationHistogramBucket(d)]++
+}
+
+// stats returns the statistics of the added durations.
+// The percentiles are estimated from the buckets.
+func (h *durationHistogram) stats() durationStats {
+
+	if h.count == 0 {
+		return durationStats{}
+	}
+
+	return durationStats{
+		count:  h.count,
+		min:    h.min,
+		max:    h.max,
+		mean:   time.Duration(h.mean),
+		p50:    h.percentile(50),
+		p90:    h.percentile(90),
+		p99:    h.percentile(99),
+		stddev: time.Duration(math.Sqrt(h.m2 / float64(h.count))),
+	}
+}
+
+// percentile returns an estimation of the given percentile.
+func (h *durationHistogram) percentile(p float64) time.Duration {
+
+	rank := int(math.Ceil(p / 100 * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen int
+	for _, i := range h.buckets() {
+		if seen += h.counts[i]; seen >= rank {
+			return h.value(i)
+		}
+	}
+
+	return h.max
+}
+
+// format returns a compact text histogram of the added durations.
+func (h *durationHistogram) format(indent string) string {
+
+	if h.count == 0 {
+		return ""
+	}
+
+	stats := h.stats()
+	width := histogramWidthFor(stats)
+
+	counts := make([]int, histogramBuckets)
+	for i, c := range h.counts {
+		counts[histogramBucket(h.value(i), stats.min, width)] += c
+	}
+
+	return formatHistogramCounts(counts, stats.min, width, indent)
+}
+
+// buckets returns the indexes of the non empty buckets in order.
+func (h *durationHistogram) buckets() []int {
+
+	out := make([]int, 0, len(h.counts))
+	for i := range h.counts {
+		out = append(out, i)
+	}
+	sort.Ints(out)
+
+	return out
+}
+
+// value returns the duration representing the given bucket,
+// which is its geometric middle within the added durations.
+func (h *durationHistogram) value(bucket int) time.Duration {
+
+	if bucket < 0 {
+		return h.min
+	}
+
+	d := time.Duration(math.Pow(durationHistogramGrowth, float64(bucket)+0.5))
+	if d < h.min {
+		return h.min
+	}
+	if d > h.max {
+		return h.max
+	}
+
+	return d
+}
+
+// durationHistogramBucket returns the index of the bucket of the given
+// duration. Durations shorter than 1ns are in their own bucket, -1.
+func durationHistogramBucket(d time.Duration) int {
+
+	if d < 1 {
+		return -1
+	}
+
+	return int(math.Floor(math.Log(float64(d)) / math.Log(durationHistogramGrowth)))
+}
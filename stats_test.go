@@ -0,0 +1,170 @@
+package apocheck
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_percentile(t *testing.T) {
+
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+	tests := []struct {
+		name   string
+		sorted []time.Duration
+		p      float64
+		want   time.Duration
+	}{
+		{"empty", nil, 50, 0},
+		{"single", []time.Duration{42}, 99, 42},
+		{"p0", sorted, 0, 1},
+		{"p10", sorted, 10, 1},
+		{"p11", sorted, 11, 2},
+		{"p50", sorted, 50, 5},
+		{"p90", sorted, 90, 9},
+		{"p99", sorted, 99, 10},
+		{"p100", sorted, 100, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := percentile(tt.sorted, tt.p); got != tt.want {
+				t.Errorf("percentile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_computeStats(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		durations []time.Duration
+		want      durationStats
+	}{
+		{
+			"empty",
+			nil,
+			durationStats{},
+		},
+		{
+			"single",
+			[]time.Duration{time.Second},
+			durationStats{
+				count:  1,
+				min:    time.Second,
+				max:    time.Second,
+				mean:   time.Second,
+				p50:    time.Second,
+				p90:    time.Second,
+				p99:    time.Second,
+				stddev: 0,
+			},
+		},
+		{
+			"unsorted",
+			[]time.Duration{4 * time.Second, 2 * time.Second, 6 * time.Second, 8 * time.Second},
+			durationStats{
+				count:  4,
+				min:    2 * time.Second,
+				max:    8 * time.Second,
+				mean:   5 * time.Second,
+				p50:    4 * time.Second,
+				p90:    8 * time.Second,
+				p99:    8 * time.Second,
+				stddev: 2236067977,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := computeStats(tt.durations); got != tt.want {
+				t.Errorf("computeStats() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_computeStatsDoesNotSort(t *testing.T) {
+
+	durations := []time.Duration{3, 1, 2}
+	computeStats(durations)
+
+	if durations[0] != 3 || durations[1] != 1 || durations[2] != 2 {
+		t.Errorf("computeStats() modified its input: %v", durations)
+	}
+}
+
+func Test_durationHistogram(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		durations []time.Duration
+	}{
+		{"single", []time.Duration{time.Second}},
+		{"zero", []time.Duration{0, 0, time.Millisecond}},
+		{"linear", func() (out []time.Duration) {
+			for i := 1; i <= 1000; i++ {
+				out = append(out, time.Duration(i)*time.Millisecond)
+			}
+			return out
+		}()},
+		{"spread", []time.Duration{time.Microsecond, time.Millisecond, time.Second, time.Minute, time.Hour}},
+	}
+
+	// within returns true if got is within the
+	// precision of the histogram from want.
+	within := func(got time.Duration, want time.Duration) bool {
+		diff := float64(got - want)
+		if diff < 0 {
+			diff = -diff
+		}
+		return diff <= float64(want)*(durationHistogramGrowth-1)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			h := newDurationHistogram()
+			for _, d := range tt.durations {
+				h.add(d)
+			}
+
+			got, want := h.stats(), computeStats(tt.durations)
+
+			if got.count != want.count || got.min != want.min || got.max != want.max {
+				t.Errorf("stats() = %+v, want %+v", got, want)
+			}
+
+			for _, p := range []struct {
+				name string
+				got  time.Duration
+				want time.Duration
+			}{
+				{"mean", got.mean, want.mean},
+				{"p50", got.p50, want.p50},
+				{"p90", got.p90, want.p90},
+				{"p99", got.p99, want.p99},
+				{"stddev", got.stddev, want.stddev},
+			} {
+				if !within(p.got, p.want) {
+					t.Errorf("stats().%s = %v, want %v", p.name, p.got, p.want)
+				}
+			}
+		})
+	}
+}
+
+func Test_durationHistogramEmpty(t *testing.T) {
+
+	h := newDurationHistogram()
+
+	if got := h.stats(); got != (durationStats{}) {
+		t.Errorf("stats() = %+v, want empty stats", got)
+	}
+
+	if got := h.format(""); got != "" {
+		t.Errorf("format() = %q, want empty string", got)
+	}
+}
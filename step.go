@@ -0,0 +1,244 @@
+package apocheck
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goterm"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// StepStatus represents the status of a step.
+type StepStatus string
+
+// Various values of StepStatus.
+const (
+	StepStatusRunning StepStatus = "running"
+	StepStatusPassed  StepStatus = "passed"
+	StepStatusFailed  StepStatus = "failed"
+)
+
+// A StepInfo contains the information about a step run by a test.
+type StepInfo struct {
+	Name     string
+	Start    time.Time
+	End      time.Time
+	Duration time.Duration
+	Status   StepStatus
+	Steps    []*StepInfo
+
+	ctx  context.Context
+	span trace.Span
+}
+
+// A StepError is the error reported when a step function returns an error.
+type StepError struct {
+	Name     string
+	Path     []string
+	Err      error
+	Duration time.Duration
+}
+
+// FullName returns the name of the step prefixed by the names of its parents.
+func (e StepError) FullName() string {
+	return strings.Join(append(append([]string{}, e.Path...), e.Name), " > ")
+}
+
+func (e StepError) Error() string {
+	return fmt.Sprintf("step '%s' failed after %s: %s", e.FullName(), e.Duration.Round(time.Millisecond), e.Err)
+}
+
+// Unwrap returns the error returned by the step function.
+func (e StepError) Unwrap() error {
+	return e.Err
+}
+
+// stepRecorder records the steps of a test iteration.
+// It is shared by all copies of a TestInfo.
+type stepRecorder struct {
+	ctx            context.Context
+	steps          []*StepInfo
+	stack          []*StepInfo
+	timeOfLastStep time.Time
+	lock           sync.Mutex
+}
+
+func newStepRecorder(ctx context.Context, start time.Time) *stepRecorder {
+	return &stepRecorder{
+		ctx:            ctx,
+		timeOfLastStep: start,
+	}
+}
+
+// begin starts a new step as a child of the current one
+// and returns it along with the names of its parents.
+func (r *stepRecorder) begin(name string) (*StepInfo, []string) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+
+	s := &StepInfo{
+		Name:   name,
+		Start:  now,
+		Status: StepStatusRunning,
+	}
+	s.ctx, s.span = tracer.Start(r.currentContext(), name)
+
+	parents := make([]string, len(r.stack))
+	for i, p := range r.stack {
+		parents[i] = p.Name
+	}
+
+	if len(r.stack) == 0 {
+		r.steps = append(r.steps, s)
+	} else {
+		parent := r.stack[len(r.stack)-1]
+		parent.Steps = append(parent.Steps, s)
+	}
+
+	r.stack = append(r.stack, s)
+	r.timeOfLastStep = now
+
+	return s, parents
+}
+
+// end terminates the given step with the given status.
+func (r *stepRecorder) end(s *StepInfo, status StepStatus) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+
+	s.End = now
+	s.Duration = now.Sub(s.Start)
+	s.Status = status
+
+	if status == StepStatusFailed {
+		s.span.SetStatus(codes.Error, "step failed")
+	}
+	s.span.End()
+
+	for i := len(r.stack) - 1; i >= 0; i-- {
+		if r.stack[i] == s {
+			r.stack = r.stack[:i]
+			break
+		}
+	}
+
+	r.timeOfLastStep = now
+}
+
+// context returns the context of the current step, or the
+// context of the iteration if no step is running.
+func (r *stepRecorder) context() context.Context {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.currentContext()
+}
+
+func (r *stepRecorder) currentContext() context.Context {
+
+	if len(r.stack) == 0 {
+		return r.ctx
+	}
+
+	return r.stack[len(r.stack)-1].ctx
+}
+
+// touch updates the time of the last step.
+func (r *stepRecorder) touch() {
+
+	r.lock.Lock()
+	r.timeOfLastStep = time.Now()
+	r.lock.Unlock()
+}
+
+// lastStepTime returns the time of the last step.
+func (r *stepRecorder) lastStepTime() time.Time {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.timeOfLastStep
+}
+
+// snapshot returns a deep copy of the recorded steps.
+func (r *stepRecorder) snapshot() []*StepInfo {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return copySteps(r.steps)
+}
+
+func copySteps(steps []*StepInfo) []*StepInfo {
+
+	if len(steps) == 0 {
+		return nil
+	}
+
+	out := make([]*StepInfo, len(steps))
+	for i, s := range steps {
+		c := *s
+		c.Steps = copySteps(s.Steps)
+		c.ctx = nil
+		c.span = nil
+		out[i] = &c
+	}
+
+	return out
+}
+
+// failedStepPath returns the names of the deepest failed step
+// and of its parents, or nil if no step failed.
+func failedStepPath(steps []*StepInfo) []string {
+
+	for _, s := range steps {
+
+		if s.Status != StepStatusFailed {
+			continue
+		}
+
+		return append([]string{s.Name}, failedStepPath(s.Steps)...)
+	}
+
+	return nil
+}
+
+// formatSteps returns the given steps as an indented tree.
+func formatSteps(steps []*StepInfo, indent string) string {
+
+	b := &strings.Builder{}
+	writeSteps(b, steps, indent)
+
+	return b.String()
+}
+
+func writeSteps(b *strings.Builder, steps []*StepInfo, indent string) {
+
+	for _, s := range steps {
+
+		var status string
+		switch s.Status {
+		case StepStatusPassed:
+			status = goterm.Color("[PASS]", goterm.GREEN)
+		case StepStatusFailed:
+			status = goterm.Color("[FAIL]", goterm.RED)
+		default:
+			status = goterm.Color("[RUNNING]", goterm.YELLOW)
+		}
+
+		fmt.Fprintf(b, "%s%s %s %s\n", indent, status, s.Name, goterm.Color(fmt.Sprintf("(%s)", s.Duration.Round(time.Millisecond)), goterm.BLUE)) // nolint
+
+		writeSteps(b, s.Steps, indent+"  ")
+	}
+}
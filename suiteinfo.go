@@ -73,9 +73,9 @@ func (s *suiteInfo) SetupInfo() interface{} {
 	return s.data
 }
 
-// Write performs a write
+// Write performs a write. Registered secrets and tokens are redacted.
 func (s *suiteInfo) Write(p []byte) (n int, err error) {
-	return s.writer.Write(p)
+	return redactedWrite(s.writer, p)
 }
 
 func (s *suiteInfo) testsWithArgs(verbose, matchAll bool, tags []string) *suiteInfo {
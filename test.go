@@ -5,6 +5,30 @@ import (
 	"strings"
 )
 
+// A Capability is something a test needs from the environment to run.
+type Capability int
+
+// Various values of Capability.
+const (
+	// PublicAPI requires the public manipulator, created from --api-public and --token.
+	PublicAPI Capability = iota + 1
+
+	// PrivateAPI requires the root manipulator, created from --api-private and --cert.
+	PrivateAPI
+)
+
+func (c Capability) String() string {
+
+	switch c {
+	case PublicAPI:
+		return "public-api"
+	case PrivateAPI:
+		return "private-api"
+	default:
+		return fmt.Sprintf("capability-%d", int(c))
+	}
+}
+
 // A Test represents an actual test.
 type Test struct {
 	id          string
@@ -12,11 +36,26 @@ type Test struct {
 	Description string
 	Author      string
 	Tags        []string
+	Requires    []Capability
 	Setup       SetupFunction
 	Function    TestFunction
 	SuiteName   string
 }
 
+// missingCapabilities returns the capabilities required by
+// the test that are not in the given available ones.
+func (t Test) missingCapabilities(available map[Capability]bool) []Capability {
+
+	var missing []Capability
+	for _, c := range t.Requires {
+		if !available[c] {
+			missing = append(missing, c)
+		}
+	}
+
+	return missing
+}
+
 // MatchTags matches all tags if --match-all is set otherwise matches any tag
 func (t Test) MatchTags(tags []string, matchAll bool) bool {
 
@@ -88,10 +127,17 @@ func (t Test) hasTag(tag string) bool {
 }
 
 func (t Test) String() string {
+
+	requires := make([]string, len(t.Requires))
+	for i, c := range t.Requires {
+		requires[i] = c.String()
+	}
+
 	return fmt.Sprintf(`  id         : %s
   name       : %s
   desc       : %s
   author     : %s
   categories : %s
-`, t.id, t.Name, t.Description, t.Author, strings.Join(t.Tags, ", "))
+  requires   : %s
+`, t.id, t.Name, t.Description, t.Author, strings.Join(t.Tags, ", "), strings.Join(requires, ", "))
 }
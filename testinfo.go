@@ -1,6 +1,7 @@
 package apocheck
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
@@ -16,15 +17,20 @@ type TestInfo struct {
 	data              interface{}
 	header            io.Writer
 	iteration         int
+	memory            *memoryBackend
 	privateAPI        string
 	privateTLSConfig  *tls.Config
 	publicAPI         string
 	publicManipulator manipulate.Manipulator
 	publicTLSConfig   *tls.Config
+	pushLatencies     *latencyRecorder
+	replaying         bool
 	rootManipulator   manipulate.Manipulator
+	steps             *stepRecorder
+	subscribers       *subscriberTracker
 	testID            string
-	timeOfLastStep    time.Time
 	timeout           time.Duration
+	transports        []transportWrapper
 	writer            io.Writer
 	encoding          elemental.EncodingType
 	suite             *suiteInfo
@@ -108,20 +114,40 @@ func (t TestInfo) PrivateTLSConfig() *tls.Config {
 
 // WriteHeader performs a write at the header
 func (t TestInfo) WriteHeader(p []byte) (n int, err error) {
-	return t.header.Write(p)
+	return redactedWrite(t.header, p)
 }
 
-// Write performs a write
+// Write performs a write. Registered secrets and tokens are redacted.
 func (t TestInfo) Write(p []byte) (n int, err error) {
-	return t.writer.Write(p)
+	return redactedWrite(t.writer, p)
+}
+
+// RegisterSecret registers secrets that will be redacted from all
+// the output of apocheck, like logs, reports and HTTP captures.
+// Secrets are kept for the whole run and each new one makes the
+// redaction slower, so register the fixed ones, not one per iteration.
+func (t TestInfo) RegisterSecret(secrets ...string) {
+	RegisterSecrets(secrets...)
 }
 
 // TimeSinceLastStep provides the time since last step or assertion
 func (t TestInfo) TimeSinceLastStep() string {
-	d := time.Since(t.timeOfLastStep)
+	d := time.Since(t.steps.lastStepTime())
 	return d.Round(time.Millisecond).String()
 }
 
+// Context returns the context of the current step, or the context
+// of the iteration if no step is running. It carries the current
+// trace span and can be used to create a manipulate.Context.
+func (t TestInfo) Context() context.Context {
+	return t.steps.context()
+}
+
+// Steps returns the steps recorded so far by the test.
+func (t TestInfo) Steps() []*StepInfo {
+	return t.steps.snapshot()
+}
+
 // Timeout provides the duration before the test timeout.
 func (t TestInfo) Timeout() time.Duration {
 	return t.timeout
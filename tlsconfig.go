@@ -0,0 +1,75 @@
+package apocheck
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+)
+
+// newTLSConfig returns a TLS config verifying the server certificate
+// of the given API against the given CA pool, or against the system
+// roots if the pool is nil, unless insecure is set. If serverName is
+// set, it is used instead of the host of the API address to verify the
+// certificate. The gateway, public or private, is used to name the
+// flags in actionable hints when the verification fails.
+func newTLSConfig(
+	api string,
+	caPool *x509.CertPool,
+	certificates []tls.Certificate,
+	serverName string,
+	insecure bool,
+	gateway string,
+) *tls.Config {
+
+	cfg := &tls.Config{
+		RootCAs:      caPool,
+		Certificates: certificates,
+		ServerName:   serverName,
+	}
+
+	if insecure {
+		cfg.InsecureSkipVerify = true // nolint
+		return cfg
+	}
+
+	if serverName == "" {
+		if u, err := url.Parse(api); err == nil {
+			serverName = u.Hostname()
+		}
+	}
+
+	// The verification is done in VerifyConnection rather than by
+	// the tls package so we can return an actionable error.
+	cfg.InsecureSkipVerify = true // nolint
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("unable to verify server certificate: no certificate presented by the server")
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		if _, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         caPool,
+			Intermediates: intermediates,
+			DNSName:       serverName,
+		}); err != nil {
+			return fmt.Errorf(
+				"unable to verify server certificate for '%s': %s. Check or give the ca with --cacert-%s, set --tls-server-name-%s if the address does not match the certificate, or use --insecure-%s to skip the verification",
+				serverName,
+				err,
+				gateway,
+				gateway,
+				gateway,
+			)
+		}
+
+		return nil
+	}
+
+	return cfg
+}
@@ -0,0 +1,165 @@
+package apocheck
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/buger/goterm"
+	midgardclient "go.aporeto.io/midgard-lib/client"
+)
+
+// A tokenIssuerFunc issues a token valid for the given duration.
+type tokenIssuerFunc func(ctx context.Context, validity time.Duration) (string, error)
+
+// newTokenIssuer returns a tokenIssuerFunc issuing tokens from the app
+// credential file at credsPath, from the given vince account and
+// password, or from the system certificate if fromCert is set.
+// It returns nil if none of them is set.
+func newTokenIssuer(
+	publicAPI string,
+	publicCAPool *x509.CertPool,
+	systemCert *tls.Certificate,
+	publicServerName string,
+	insecurePublic bool,
+	credsPath string,
+	account string,
+	password string,
+	fromCert bool,
+) (tokenIssuerFunc, error) {
+
+	switch {
+
+	case credsPath != "":
+
+		data, err := os.ReadFile(credsPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read app credential '%s': %s", credsPath, err)
+		}
+
+		creds, tlsConfig, err := midgardclient.ParseCredentials(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse app credential '%s': %s", credsPath, err)
+		}
+
+		client := midgardclient.NewClientWithTLS(creds.APIURL, tlsConfig)
+
+		return func(ctx context.Context, validity time.Duration) (string, error) {
+			return client.IssueFromCertificate(ctx, validity)
+		}, nil
+
+	case account != "":
+
+		client := midgardclient.NewClientWithTLS(
+			publicAPI,
+			newTLSConfig(publicAPI, publicCAPool, nil, publicServerName, insecurePublic, "public"),
+		)
+
+		return func(ctx context.Context, validity time.Duration) (string, error) {
+			return client.IssueFromVince(ctx, account, password, "", validity)
+		}, nil
+
+	case fromCert:
+
+		if systemCert == nil {
+			return nil, fmt.Errorf("--token-from-cert requires --cert and --key")
+		}
+
+		client := midgardclient.NewClientWithTLS(
+			publicAPI,
+			newTLSConfig(publicAPI, publicCAPool, []tls.Certificate{*systemCert}, publicServerName, insecurePublic, "public"),
+		)
+
+		return func(ctx context.Context, validity time.Duration) (string, error) {
+			return client.IssueFromCertificate(ctx, validity)
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// A sharedTokenManager is a manipulate.TokenManager sharing the token
+// it issues between all the manipulators using it. The token is renewed
+// once half of its validity elapsed, so runs can outlive it.
+type sharedTokenManager struct {
+	issuer   tokenIssuerFunc
+	validity time.Duration
+	token    string
+	issued   time.Time
+	lock     sync.Mutex
+}
+
+func newSharedTokenManager(issuer tokenIssuerFunc, validity time.Duration) *sharedTokenManager {
+	return &sharedTokenManager{
+		issuer:   issuer,
+		validity: validity,
+	}
+}
+
+// Issue returns the current token, issuing a new one if
+// half of the validity of the current one elapsed.
+func (m *sharedTokenManager) Issue(ctx context.Context) (string, error) {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.token != "" && time.Since(m.issued) < m.validity/2 {
+		return m.token, nil
+	}
+
+	issued := time.Now()
+	token, err := m.issuer(ctx, m.validity)
+	if err != nil {
+		return "", fmt.Errorf("unable to issue token: %s", err)
+	}
+
+	// The token is a JWT, which is redacted without being registered.
+	// Registering every renewed token would grow the secrets forever.
+	m.token = token
+	m.issued = issued
+
+	return token, nil
+}
+
+// Run sends the renewed tokens to the given channel until
+// the given context is canceled.
+func (m *sharedTokenManager) Run(ctx context.Context, tokenCh chan string) {
+
+	ticker := time.NewTicker(m.validity / 4)
+	defer ticker.Stop()
+
+	var last string
+
+	for {
+		select {
+
+		case <-ticker.C:
+
+			token, err := m.Issue(ctx)
+			if err != nil {
+				printLock.Lock()
+				fmt.Println(goterm.Color(fmt.Sprintf("warning: %s. Will retry in %s", err, m.validity/4), goterm.YELLOW))
+				printLock.Unlock()
+				continue
+			}
+
+			if token == last {
+				continue
+			}
+			last = token
+
+			select {
+			case tokenCh <- token:
+			case <-ctx.Done():
+				return
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package apocheck
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of suites, tests, iterations and steps.
+// Spans are not recorded unless setupTracing has been called.
+var tracer = otel.Tracer("go.aporeto.io/apocheck")
+
+// setupTracing configures the export of the traces to the given endpoint.
+// The endpoint is either the URL of an OTLP HTTP collector, or a file://
+// URL to write the spans as JSON in a local file.
+// It returns a function to flush the remaining spans and stop the export.
+func setupTracing(ctx context.Context, serviceName string, endpoint string) (func(), error) {
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid otlp endpoint '%s': %s", endpoint, err)
+	}
+
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+
+	switch u.Scheme {
+
+	case "file":
+		file, err = os.Create(u.Path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create trace file '%s': %s", u.Path, err)
+		}
+
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+
+	case "http", "https":
+		opts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(u.Host),
+		}
+
+		if u.Scheme == "http" {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+
+		if u.Path != "" && u.Path != "/" {
+			opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+		}
+
+		exporter, err = otlptracehttp.New(ctx, opts...)
+
+	default:
+		return nil, fmt.Errorf("invalid otlp endpoint '%s': scheme must be http, https or file", endpoint)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to create trace exporter: %s", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return func() {
+		provider.Shutdown(context.Background()) // nolint
+		if file != nil {
+			file.Close() // nolint
+		}
+	}, nil
+}
+
+// testAttributes returns the span attributes of the given test.
+func testAttributes(t Test) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("apocheck.test.id", t.id),
+		attribute.String("apocheck.test.name", t.Name),
+		attribute.String("apocheck.suite.name", suiteLabel(t)),
+		attribute.StringSlice("apocheck.test.tags", t.Tags),
+	}
+}
+
+// endSpan ends the given span, setting its status from the given error.
+func endSpan(span trace.Span, err error) {
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// traceTransport returns a transportWrapper injecting the trace context
+// in the requests headers. If the request context has no span, the
+// context returned by fallback is used.
+func traceTransport(fallback func() context.Context) transportWrapper {
+
+	return func(next http.RoundTripper) http.RoundTripper {
+
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+
+			ctx := req.Context()
+			if !trace.SpanContextFromContext(ctx).IsValid() {
+				ctx = fallback()
+			}
+
+			req = req.Clone(req.Context())
+			otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+			return next.RoundTrip(req)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package apocheck
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+
+	"go.aporeto.io/manipulate/maniphttp"
+)
+
+// A transportWrapper wraps the http.RoundTripper used by
+// the manipulators created by apocheck.
+type transportWrapper func(http.RoundTripper) http.RoundTripper
+
+// A roundTripperFunc is a function implementing http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// baseTransports holds the http.Transport shared by all
+// the manipulators using the same TLS config.
+var baseTransports sync.Map
+
+// baseTransport returns the shared http.Transport for the given TLS config.
+func baseTransport(tlsConfig *tls.Config) http.RoundTripper {
+
+	if t, ok := baseTransports.Load(tlsConfig); ok {
+		return t.(http.RoundTripper)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	t, _ := baseTransports.LoadOrStore(tlsConfig, transport)
+
+	return t.(http.RoundTripper)
+}
+
+// newHTTPClient returns an http.Client using the given TLS config
+// with its transport wrapped by the given wrappers.
+func newHTTPClient(tlsConfig *tls.Config, wrappers []transportWrapper) *http.Client {
+
+	rt := baseTransport(tlsConfig)
+	for _, w := range wrappers {
+		rt = w(rt)
+	}
+
+	return &http.Client{Transport: rt}
+}
+
+// httpOptions returns the maniphttp options to use the given TLS config.
+// If there is any transport wrapper, the manipulator will use an http.Client
+// wrapped by them.
+func httpOptions(tlsConfig *tls.Config, wrappers []transportWrapper) []maniphttp.Option {
+
+	opts := []maniphttp.Option{
+		maniphttp.OptionTLSConfig(tlsConfig),
+	}
+
+	if len(wrappers) > 0 {
+		opts = append(opts, maniphttp.OptionHTTPClient(newHTTPClient(tlsConfig, wrappers)))
+	}
+
+	return opts
+}
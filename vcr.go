@@ -0,0 +1,342 @@
+package apocheck
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"go.aporeto.io/elemental"
+	"go.aporeto.io/manipulate"
+)
+
+// vcrSkippedHeaders are the request headers not stored in recordings.
+var vcrSkippedHeaders = map[string]struct{}{
+	"Authorization": {},
+	"Cookie":        {},
+}
+
+// vcrSkippedResponseHeaders are the response headers not stored in
+// recordings. Content-Length is not stored as the redaction of the
+// body can change its length.
+var vcrSkippedResponseHeaders = map[string]struct{}{
+	"Set-Cookie":     {},
+	"Content-Length": {},
+}
+
+// vcrMatchedHeaders are the request headers a recorded interaction must
+// have in common with a request to be preferred when replaying it, as
+// requests with the same URI can target different namespaces or ask for
+// different encodings.
+var vcrMatchedHeaders = []string{
+	"X-Namespace",
+	"Accept",
+}
+
+// A vcrInteraction is a recorded HTTP request and its response.
+type vcrInteraction struct {
+	Method         string      `json:"method"`
+	URI            string      `json:"uri"`
+	RequestHeader  http.Header `json:"requestHeader,omitempty"`
+	RequestBody    []byte      `json:"requestBody,omitempty"`
+	Status         int         `json:"status"`
+	ResponseHeader http.Header `json:"responseHeader,omitempty"`
+	ResponseBody   []byte      `json:"responseBody,omitempty"`
+
+	replayed bool
+}
+
+// A replayManipulator is a manipulator answered from a cassette. Push
+// subscriptions use a websocket that is neither recorded nor replayed, so
+// they cannot be started with it.
+type replayManipulator struct {
+	manipulate.Manipulator
+}
+
+// A cassette holds the HTTP interactions of a test iteration so they
+// can be replayed later. It also holds the test ID used during the
+// recording, as it is part of the names of the created objects.
+type cassette struct {
+	TestID       string            `json:"testID"`
+	Interactions []*vcrInteraction `json:"interactions"`
+
+	lock sync.Mutex
+}
+
+// cassettePath returns the path of the cassette of the given test iteration.
+func cassettePath(dir string, testID string, iteration int) string {
+	return filepath.Join(dir, testID, fmt.Sprintf("%d.json", iteration+1))
+}
+
+// loadCassette loads the cassette of the given test iteration.
+func loadCassette(dir string, testID string, iteration int) (*cassette, error) {
+
+	path := cassettePath(dir, testID, iteration)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load recording '%s' of test '%s' iteration %d: %s", path, testID, iteration+1, err)
+	}
+
+	c := &cassette{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("unable to decode recording '%s': %s", path, err)
+	}
+
+	return c, nil
+}
+
+// save saves the cassette of the given test iteration.
+func (c *cassette) save(dir string, testID string, iteration int) error {
+
+	c.lock.Lock()
+	data, err := json.MarshalIndent(c, "", "  ")
+	c.lock.Unlock()
+	if err != nil {
+		return fmt.Errorf("unable to encode recording: %s", err)
+	}
+
+	path := cassettePath(dir, testID, iteration)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("unable to create recording directory: %s", err)
+	}
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("unable to write recording '%s': %s", path, err)
+	}
+
+	return nil
+}
+
+// record is a transportWrapper recording the interactions in the cassette.
+func (c *cassette) record(next http.RoundTripper) http.RoundTripper {
+
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+
+		i := &vcrInteraction{
+			Method:         req.Method,
+			URI:            req.URL.RequestURI(),
+			RequestHeader:  filterHeader(req.Header, vcrSkippedHeaders),
+			ResponseHeader: http.Header{},
+		}
+
+		if req.Body != nil && req.Body != http.NoBody {
+			data, err := io.ReadAll(req.Body)
+			req.Body.Close() // nolint
+			if err != nil {
+				return nil, err
+			}
+
+			i.RequestBody = redactBody(req.Header.Get("Content-Type"), data)
+
+			req = req.Clone(req.Context())
+			req.Body = io.NopCloser(bytes.NewReader(data))
+		}
+
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close() // nolint
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+
+		i.Status = resp.StatusCode
+		i.ResponseHeader = filterHeader(resp.Header, vcrSkippedResponseHeaders)
+		i.ResponseBody = redactBody(resp.Header.Get("Content-Type"), data)
+
+		c.lock.Lock()
+		c.Interactions = append(c.Interactions, i)
+		c.lock.Unlock()
+
+		return resp, nil
+	})
+}
+
+// replay is a transportWrapper answering the requests with the interactions
+// of the cassette, without calling the next round tripper. It stands in for
+// the api in process, instead of a local HTTP server, so the manipulators
+// keep their address and the recorded URIs match. Each request is
+// answered by a recorded interaction not replayed yet with the same method
+// and URI, so the requests made concurrently can be replayed in any order.
+// The interactions with the same matched headers are preferred, then the
+// ones with the same body, then the first one. It fails if no such
+// interaction is left.
+func (c *cassette) replay(next http.RoundTripper) http.RoundTripper {
+
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+
+		var body []byte
+		if req.Body != nil && req.Body != http.NoBody {
+			data, err := io.ReadAll(req.Body)
+			req.Body.Close() // nolint
+			if err != nil {
+				return nil, err
+			}
+			body = redactBody(req.Header.Get("Content-Type"), data)
+		}
+
+		uri := req.URL.RequestURI()
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		var match *vcrInteraction
+		best := -1
+		for _, i := range c.Interactions {
+			if i.replayed || i.Method != req.Method || i.URI != uri {
+				continue
+			}
+			if score := i.score(req.Header, body); score > best {
+				match, best = i, score
+			}
+		}
+
+		if match == nil {
+			return nil, fmt.Errorf("replay: unexpected request %s %s: no such request left in the %d recorded ones", req.Method, uri, len(c.Interactions))
+		}
+
+		match.replayed = true
+
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", match.Status, http.StatusText(match.Status)),
+			StatusCode:    match.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        match.ResponseHeader.Clone(),
+			Body:          io.NopCloser(bytes.NewReader(match.ResponseBody)),
+			ContentLength: int64(len(match.ResponseBody)),
+			Request:       req,
+		}, nil
+	})
+}
+
+// score returns how closely the interaction matches a request with the
+// given header and redacted body. The matched headers weigh more than
+// the body, as a different namespace means a different response.
+func (i *vcrInteraction) score(header http.Header, body []byte) int {
+
+	var score int
+
+	headersMatch := true
+	for _, k := range vcrMatchedHeaders {
+		if i.RequestHeader.Get(k) != header.Get(k) {
+			headersMatch = false
+			break
+		}
+	}
+
+	if headersMatch {
+		score += 2
+	}
+
+	if bytes.Equal(i.RequestBody, body) {
+		score++
+	}
+
+	return score
+}
+
+// remaining returns the recorded requests that were not replayed.
+func (c *cassette) remaining() []string {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var out []string
+	for _, i := range c.Interactions {
+		if !i.replayed {
+			out = append(out, fmt.Sprintf("%s %s", i.Method, i.URI))
+		}
+	}
+
+	return out
+}
+
+// filterHeader returns a copy of the given header without the skipped ones.
+func filterHeader(header http.Header, skipped map[string]struct{}) http.Header {
+
+	out := http.Header{}
+	for k, v := range header {
+		if _, ok := skipped[http.CanonicalHeaderKey(k)]; !ok {
+			out[k] = append([]string{}, v...)
+		}
+	}
+
+	return out
+}
+
+// redactBody returns the given body without the registered secrets, the
+// tokens and the values of the sensitive fields. Msgpack bodies are decoded
+// and encoded again so their framing stays valid. They are returned as is if
+// they cannot be decoded.
+func redactBody(contentType string, data []byte) []byte {
+
+	if len(data) == 0 {
+		return data
+	}
+
+	if !strings.Contains(contentType, "msgpack") {
+		return []byte(mainRedactor.redact(sensitiveFieldsRegexp.ReplaceAllString(string(data), `$1"`+redactedPlaceholder+`"`)))
+	}
+
+	var obj interface{}
+	if err := elemental.Decode(elemental.EncodingTypeMSGPACK, data, &obj); err != nil {
+		return data
+	}
+
+	out, err := elemental.Encode(elemental.EncodingTypeMSGPACK, redactValue(obj))
+	if err != nil {
+		return data
+	}
+
+	return out
+}
+
+// redactValue returns the given decoded value without the registered
+// secrets, the tokens and the values of the sensitive fields.
+func redactValue(v interface{}) interface{} {
+
+	switch v := v.(type) {
+
+	case string:
+		return mainRedactor.redact(v)
+
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+
+	case map[string]interface{}:
+		for k := range v {
+			if _, ok := v[k].(string); ok && sensitiveFieldNameRegexp.MatchString(k) {
+				v[k] = redactedPlaceholder
+				continue
+			}
+			v[k] = redactValue(v[k])
+		}
+
+	case map[interface{}]interface{}:
+		for k := range v {
+			if _, ok := v[k].(string); ok && sensitiveFieldNameRegexp.MatchString(fmt.Sprint(k)) {
+				v[k] = redactedPlaceholder
+				continue
+			}
+			v[k] = redactValue(v[k])
+		}
+	}
+
+	return v
+}